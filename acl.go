@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 连接被 ACL 拒绝的原因
+const (
+	aclReasonDenied     = "denied"      // 在 deny 中
+	aclReasonNotAllowed = "not_allowed" // allow 不为空并且不在 allow 中
+)
+
+// listenerACLs 当前生效的 ACL,重新加载时整体替换
+var listenerACLs atomic.Pointer[aclSet]
+
+// aclSet 全局的 ACL 和按监听器标签覆盖的 ACL
+type aclSet struct {
+	global    *ipACL
+	listeners map[string]*ipACL
+}
+
+type ipACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newACLSet(cfg ACL) (*aclSet, error) {
+	global, err := newIPACL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	set := &aclSet{global: global, listeners: make(map[string]*ipACL)}
+	for tag, lc := range cfg.Listeners {
+		acl, err := newIPACL(lc)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %v", tag, err)
+		}
+		set.listeners[tag] = acl
+	}
+	return set, nil
+}
+
+func newIPACL(cfg ACL) (*ipACL, error) {
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("acl allow: %v", err)
+	}
+	deny, err := parsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("acl deny: %v", err)
+	}
+	return &ipACL{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes 解析 CIDR,单个 IP 当作只包含它自己的网段
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// check 返回拒绝的原因,允许时返回空字符串
+func (a *ipACL) check(ip netip.Addr) string {
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return aclReasonDenied
+		}
+	}
+	if len(a.allow) == 0 {
+		return ""
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return ""
+		}
+	}
+	return aclReasonNotAllowed
+}
+
+// aclReject 按监听器标签检查客户端地址,返回拒绝的原因,允许时返回空字符串
+func aclReject(tag string, addr net.Addr) string {
+	set := listenerACLs.Load()
+	if set == nil {
+		return ""
+	}
+	acl, ok := set.listeners[tag]
+	if !ok {
+		acl = set.global
+	}
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		// unix socket 等没有 IP 的连接不受限制
+		return ""
+	}
+	return acl.check(ap.Addr().Unmap())
+}
+
+// initACL 加载 ACL,并在收到 SIGHUP 时从 config.yaml 重新加载
+// 重新加载失败时保留当前的 ACL
+func initACL(cfg ACL) error {
+	set, err := newACLSet(cfg)
+	if err != nil {
+		return err
+	}
+	listenerACLs.Store(set)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadACL(readConfig); err != nil {
+				logrus.Errorf("重新加载 ACL 失败,继续使用之前的 ACL: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadACL 用 load 读取的配置替换 listenerACLs,出错时不修改
+func reloadACL(load func() (Config, error)) error {
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	set, err := newACLSet(cfg.ACL)
+	if err != nil {
+		return err
+	}
+	listenerACLs.Store(set)
+	logrus.Infof("已重新加载 ACL: allow %d deny %d, %d 个监听器单独配置", len(set.global.allow), len(set.global.deny), len(set.listeners))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// withACL 使用 cfg 生成的 ACL,测试结束时恢复
+func withACL(t *testing.T, cfg ACL) {
+	t.Helper()
+	old := listenerACLs.Load()
+	t.Cleanup(func() { listenerACLs.Store(old) })
+	set, err := newACLSet(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenerACLs.Store(set)
+}
+
+func tcpAddr(ip string) net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(ip), 50000))
+}
+
+func TestACLCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ACL
+		ip   string
+		want string
+	}{
+		{"empty allows all", ACL{}, "203.0.113.9", ""},
+		{"denied ip", ACL{Deny: []string{"203.0.113.9"}}, "203.0.113.9", aclReasonDenied},
+		{"other ip not denied", ACL{Deny: []string{"203.0.113.9"}}, "203.0.113.10", ""},
+		{"in allowed cidr", ACL{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", ""},
+		{"outside allowed cidr", ACL{Allow: []string{"10.0.0.0/8"}}, "192.168.1.1", aclReasonNotAllowed},
+		{"deny wins over allow", ACL{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.9.0.0/16"}}, "10.9.1.1", aclReasonDenied},
+		{"unmasked cidr", ACL{Allow: []string{"10.1.2.3/8"}}, "10.200.0.1", ""},
+		{"ipv6 in cidr", ACL{Allow: []string{"2001:db8::/32"}}, "2001:db8:1::5", ""},
+		{"ipv6 outside cidr", ACL{Allow: []string{"2001:db8::/32"}}, "2001:db9::1", aclReasonNotAllowed},
+		{"ipv6 single address", ACL{Deny: []string{"2001:db8::1"}}, "2001:db8::1", aclReasonDenied},
+		{"ipv4 does not match ipv6 cidr", ACL{Allow: []string{"::/0"}}, "192.0.2.1", aclReasonNotAllowed},
+		{"ipv4-mapped client", ACL{Allow: []string{"192.0.2.0/24"}}, "::ffff:192.0.2.7", ""},
+		{"ipv4-mapped rule", ACL{Deny: []string{"::ffff:192.0.2.7"}}, "192.0.2.7", aclReasonDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withACL(t, tt.cfg)
+			if got := aclReject("", tcpAddr(tt.ip)); got != tt.want {
+				t.Fatalf("aclReject(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLInvalidAddress(t *testing.T) {
+	for _, cfg := range []ACL{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"not-an-ip"}},
+		{Listeners: map[string]ACL{"office": {Allow: []string{"2001:db8::/129"}}}},
+	} {
+		if _, err := newACLSet(cfg); err == nil {
+			t.Errorf("newACLSet(%+v) succeeded", cfg)
+		}
+	}
+}
+
+// 监听器单独配置的 ACL 替换全局的 ACL,没有 IP 的连接不受限制
+func TestACLPerListener(t *testing.T) {
+	withACL(t, ACL{
+		Deny:      []string{"192.0.2.0/24"},
+		Listeners: map[string]ACL{"office": {Allow: []string{"198.51.100.0/24"}}},
+	})
+	tests := []struct {
+		tag  string
+		addr net.Addr
+		want string
+	}{
+		{"", tcpAddr("192.0.2.1"), aclReasonDenied},
+		{"other", tcpAddr("198.51.100.1"), ""},
+		{"office", tcpAddr("192.0.2.1"), aclReasonNotAllowed},
+		{"office", tcpAddr("198.51.100.1"), ""},
+		{"", &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}, aclReasonDenied},
+		{"", &net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := aclReject(tt.tag, tt.addr); got != tt.want {
+			t.Errorf("aclReject(%q, %s) = %q, want %q", tt.tag, tt.addr, got, tt.want)
+		}
+	}
+}
+
+// 重新加载后按新的 ACL 判断,加载失败时保留之前的 ACL
+func TestACLReload(t *testing.T) {
+	withACL(t, ACL{})
+	client := tcpAddr("192.0.2.1")
+	if got := aclReject("", client); got != "" {
+		t.Fatalf("before reload: %q, want allowed", got)
+	}
+
+	load := func(cfg ACL) func() (Config, error) {
+		return func() (Config, error) { return Config{ACL: cfg}, nil }
+	}
+	if err := reloadACL(load(ACL{Deny: []string{"192.0.2.0/24"}})); err != nil {
+		t.Fatal(err)
+	}
+	if got := aclReject("", client); got != aclReasonDenied {
+		t.Fatalf("after reload: %q, want denied", got)
+	}
+
+	if err := reloadACL(load(ACL{Deny: []string{"192.0.2.0/99"}})); err == nil {
+		t.Fatal("reload with an invalid CIDR succeeded")
+	}
+	if err := reloadACL(func() (Config, error) { return Config{}, errors.New("read failed") }); err == nil {
+		t.Fatal("reload with an unreadable config succeeded")
+	}
+	if got := aclReject("", client); got != aclReasonDenied {
+		t.Fatalf("after failed reloads: %q, want the previous ACL (denied)", got)
+	}
+
+	// 再次重新加载在上一次的基础上替换,而不是启动时的 ACL
+	if err := reloadACL(load(ACL{Allow: []string{"2001:db8::/32"}})); err != nil {
+		t.Fatal(err)
+	}
+	if got := aclReject("", client); got != aclReasonNotAllowed {
+		t.Fatalf("after second reload: %q, want not allowed", got)
+	}
+	if got := aclReject("", tcpAddr("2001:db8::10")); got != "" {
+		t.Fatalf("ipv6 client after second reload: %q, want allowed", got)
+	}
+}
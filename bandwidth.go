@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 限速的方向,也是指标中 direction 标签的值
+const (
+	bandwidthUpload   = "upload"   // 客户端发往目标
+	bandwidthDownload = "download" // 目标发往客户端
+)
+
+// 每次读写的最大字节数,令牌桶按块排队,同一个桶中的连接轮流取得令牌
+const bandwidthChunk = 32 * 1024
+
+// trafficShaper 为 nil 时不限速
+var trafficShaper *bandwidthShaper
+
+// bandwidthShaper 按客户端 IP、规则和上游的令牌桶限速
+// 一个连接的数据同时经过它所属的所有桶,等待时间取其中最长的
+type bandwidthShaper struct {
+	perClient BandwidthLimit
+	upstreams map[string]BandwidthLimit
+	// 测试时可以替换为假的时钟
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	mu             sync.Mutex
+	clientBuckets  map[string]*bandwidthBuckets
+	ruleBuckets    map[*Rule]*bandwidthBuckets
+	upstreamBucket map[string]*bandwidthBuckets
+	lastPrune      time.Time
+}
+
+// bandwidthBuckets 一个限速对象上传和下载方向的令牌桶,不限速的方向为 nil
+// 桶的容量等于每秒的速率
+type bandwidthBuckets struct {
+	upload, download *tokenBucket
+}
+
+func newBandwidthBuckets(l BandwidthLimit, now time.Time) *bandwidthBuckets {
+	b := &bandwidthBuckets{}
+	if l.Upload > 0 {
+		b.upload = newTokenBucket(float64(l.Upload), 0, now)
+	}
+	if l.Download > 0 {
+		b.download = newTokenBucket(float64(l.Download), 0, now)
+	}
+	return b
+}
+
+func (b *bandwidthBuckets) get(dir string) *tokenBucket {
+	if dir == bandwidthUpload {
+		return b.upload
+	}
+	return b.download
+}
+
+// initBandwidth 检查限速配置,配置了任何限速时创建 trafficShaper
+func initBandwidth(cfg *Config) error {
+	check := func(l BandwidthLimit) error {
+		if l.Upload < 0 || l.Download < 0 {
+			return fmt.Errorf("negative bandwidth limit %+v", l)
+		}
+		return nil
+	}
+	enabled := cfg.Bandwidth.PerClient.enabled()
+	if err := check(cfg.Bandwidth.PerClient); err != nil {
+		return fmt.Errorf("bandwidth.perClient: %v", err)
+	}
+	for _, rule := range cfg.Rules {
+		if err := check(rule.Bandwidth); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.DomainPattern, err)
+		}
+		enabled = enabled || rule.Bandwidth.enabled()
+	}
+	upstreams := make(map[string]BandwidthLimit)
+	for _, u := range cfg.Upstreams {
+		if err := check(u.Bandwidth); err != nil {
+			return fmt.Errorf("upstream %s: %v", u.Addr, err)
+		}
+		if u.Bandwidth.enabled() {
+			upstreams[u.Addr] = u.Bandwidth
+			enabled = true
+		}
+	}
+	if enabled {
+		trafficShaper = newBandwidthShaper(cfg.Bandwidth.PerClient, upstreams)
+	}
+	return nil
+}
+
+func newBandwidthShaper(perClient BandwidthLimit, upstreams map[string]BandwidthLimit) *bandwidthShaper {
+	s := &bandwidthShaper{
+		perClient:      perClient,
+		upstreams:      upstreams,
+		now:            time.Now,
+		after:          time.After,
+		clientBuckets:  make(map[string]*bandwidthBuckets),
+		ruleBuckets:    make(map[*Rule]*bandwidthBuckets),
+		upstreamBucket: make(map[string]*bandwidthBuckets),
+	}
+	s.lastPrune = s.now()
+	return s
+}
+
+// bandwidthFlow 一个连接(普通 HTTP 是一个请求)经过的限速对象
+type bandwidthFlow struct {
+	s        *bandwidthShaper
+	client   string // 客户端 IP,为空时不按客户端限速
+	rule     *Rule
+	upstream string // proxy 方式的上游地址
+
+	done      chan struct{} // 连接关闭时关闭,结束正在进行的等待
+	closeOnce sync.Once
+}
+
+// newFlow 返回 attempt 的连接经过的限速对象,都不限速时返回 nil
+func (s *bandwidthShaper) newFlow(client string, attempt upstreamAttempt) *bandwidthFlow {
+	f := &bandwidthFlow{s: s, done: make(chan struct{})}
+	if s.perClient.enabled() {
+		f.client = client
+	}
+	if attempt.rule != nil && attempt.rule.Bandwidth.enabled() {
+		f.rule = attempt.rule
+	}
+	if attempt.method == "proxy" && s.upstreams[attempt.addr].enabled() {
+		f.upstream = attempt.addr
+	}
+	if f.client == "" && f.rule == nil && f.upstream == "" {
+		return nil
+	}
+	return f
+}
+
+// wait 从 dir 方向的所有桶中取走 n 个令牌,令牌不足时等待
+// 令牌允许欠账,先到的请求先还清,每个连接每次最多取一块,因此同一个桶中的连接平分带宽
+func (f *bandwidthFlow) wait(dir string, n int) error {
+	s := f.s
+	s.mu.Lock()
+	now := s.now()
+	s.pruneLocked(now)
+	var delay time.Duration
+	for _, b := range s.bucketsLocked(f, now) {
+		if tb := b.get(dir); tb != nil {
+			delay = max(delay, tb.reserve(n, now))
+		}
+	}
+	s.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	bandwidthDelay.WithLabelValues(dir).Add(delay.Seconds())
+	select {
+	case <-s.after(delay):
+		return nil
+	case <-f.done:
+		return net.ErrClosed
+	}
+}
+
+// bucketsLocked 返回 f 经过的桶,不存在时创建
+func (s *bandwidthShaper) bucketsLocked(f *bandwidthFlow, now time.Time) []*bandwidthBuckets {
+	var list []*bandwidthBuckets
+	if f.client != "" {
+		b := s.clientBuckets[f.client]
+		if b == nil {
+			b = newBandwidthBuckets(s.perClient, now)
+			s.clientBuckets[f.client] = b
+		}
+		list = append(list, b)
+	}
+	if f.rule != nil {
+		b := s.ruleBuckets[f.rule]
+		if b == nil {
+			b = newBandwidthBuckets(f.rule.Bandwidth, now)
+			s.ruleBuckets[f.rule] = b
+		}
+		list = append(list, b)
+	}
+	if f.upstream != "" {
+		b := s.upstreamBucket[f.upstream]
+		if b == nil {
+			b = newBandwidthBuckets(s.upstreams[f.upstream], now)
+			s.upstreamBucket[f.upstream] = b
+		}
+		list = append(list, b)
+	}
+	return list
+}
+
+// pruneLocked 定期删除已经回满的客户端令牌桶,回满的桶和新建的桶没有区别
+// 规则和上游的桶数量有限,不删除
+func (s *bandwidthShaper) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < limitPruneInterval {
+		return
+	}
+	s.lastPrune = now
+	full := func(b *tokenBucket) bool {
+		if b == nil {
+			return true
+		}
+		b.refill(now)
+		return b.tokens >= b.burst
+	}
+	for ip, b := range s.clientBuckets {
+		if full(b.upload) && full(b.download) {
+			delete(s.clientBuckets, ip)
+		}
+	}
+}
+
+// chunk 返回 dir 方向每次读写的最大字节数,不超过任何一个桶的容量,避免一次等待太久
+func (f *bandwidthFlow) chunk(dir string) int {
+	n := bandwidthChunk
+	limit := func(l BandwidthLimit) {
+		if rate := l.rate(dir); rate > 0 {
+			n = min(n, int(max(rate, 1)))
+		}
+	}
+	if f.client != "" {
+		limit(f.s.perClient)
+	}
+	if f.rule != nil {
+		limit(f.rule.Bandwidth)
+	}
+	if f.upstream != "" {
+		limit(f.s.upstreams[f.upstream])
+	}
+	return n
+}
+
+func (f *bandwidthFlow) close() {
+	f.closeOnce.Do(func() { close(f.done) })
+}
+
+// read 从 r 读取 dir 方向的数据,读到数据后按读到的字节数等待
+func (f *bandwidthFlow) read(r io.Reader, dir string, p []byte) (int, error) {
+	if c := f.chunk(dir); len(p) > c {
+		p = p[:c]
+	}
+	n, err := r.Read(p)
+	if n > 0 {
+		if werr := f.wait(dir, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// write 把 p 分块写入 w,每块写入之前等待
+func (f *bandwidthFlow) write(w io.Writer, dir string, p []byte) (int, error) {
+	c := f.chunk(dir)
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), c)]
+		if err := f.wait(dir, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// shapedConn 限速的客户端连接: 读取是上传,写入是下载
+type shapedConn struct {
+	net.Conn
+	flow *bandwidthFlow
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	return c.flow.read(c.Conn, bandwidthUpload, p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	return c.flow.write(c.Conn, bandwidthDownload, p)
+}
+
+func (c *shapedConn) Close() error {
+	c.flow.close()
+	return c.Conn.Close()
+}
+
+// shapedBody 限速的请求体,读取是上传
+type shapedBody struct {
+	io.ReadCloser
+	flow *bandwidthFlow
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	return b.flow.read(b.ReadCloser, bandwidthUpload, p)
+}
+
+// shapeConn 按 attempt 的路由结果为客户端连接限速,不限速时返回 conn 本身
+func shapeConn(conn net.Conn, attempt upstreamAttempt) net.Conn {
+	if trafficShaper == nil {
+		return conn
+	}
+	flow := trafficShaper.newFlow(clientIP(conn.RemoteAddr()), attempt)
+	if flow == nil {
+		return conn
+	}
+	return &shapedConn{Conn: conn, flow: flow}
+}
+
+// releaseShapedConn 结束 conn(shapeConn 的返回值)的限速对象,正在进行的等待立即返回
+// 普通 HTTP 的客户端连接在多个请求之间复用,每个请求结束时调用,不关闭连接本身
+func releaseShapedConn(conn net.Conn) {
+	if sc, ok := conn.(*shapedConn); ok {
+		sc.flow.close()
+	}
+}
+
+// shapeRequestBody 为请求体限速,使用和 conn(shapeConn 的返回值)相同的限速对象
+func shapeRequestBody(conn net.Conn, body io.ReadCloser) io.ReadCloser {
+	sc, ok := conn.(*shapedConn)
+	if !ok || body == nil || body == http.NoBody {
+		return body
+	}
+	return &shapedBody{ReadCloser: body, flow: sc.flow}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeClock 替换 bandwidthShaper 的时钟,after 记录需要等待的时间并立即返回,
+// 由 simulateFlows 推进时间
+type fakeClock struct {
+	now    time.Time
+	waited time.Duration
+}
+
+func newFakeClockShaper(perClient BandwidthLimit) (*bandwidthShaper, *fakeClock) {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newBandwidthShaper(perClient, nil)
+	s.now = func() time.Time { return c.now }
+	s.after = func(d time.Duration) <-chan time.Time {
+		c.waited = d
+		ch := make(chan time.Time, 1)
+		ch <- c.now.Add(d)
+		return ch
+	}
+	s.lastPrune = c.now
+	return s, c
+}
+
+// simulateFlows 模拟多个连接同时不断地传输 dir 方向的数据,持续 duration 的假时间,
+// 返回每个连接传输的字节数。每一步让最早结束等待的连接传输一块,
+// 同时结束等待的连接中最久没有传输的先传输
+func simulateFlows(t *testing.T, c *fakeClock, flows []*bandwidthFlow, dir string, duration time.Duration) []int64 {
+	t.Helper()
+	start := c.now
+	ready := make([]time.Time, len(flows))
+	lastStep := make([]int, len(flows))
+	sent := make([]int64, len(flows))
+	buf := make([]byte, bandwidthChunk)
+	for i := range ready {
+		ready[i] = start
+	}
+	for step := 1; ; step++ {
+		next := 0
+		for i := range ready {
+			if ready[i].Before(ready[next]) || ready[i].Equal(ready[next]) && lastStep[i] < lastStep[next] {
+				next = i
+			}
+		}
+		lastStep[next] = step
+		if ready[next].Sub(start) >= duration {
+			return sent
+		}
+		c.now, c.waited = ready[next], 0
+		f := flows[next]
+		var n int
+		var err error
+		if dir == bandwidthUpload {
+			n, err = f.read(patternReader{}, dir, buf)
+		} else {
+			n, err = f.write(io.Discard, dir, buf[:f.chunk(dir)])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent[next] += int64(n)
+		ready[next] = c.now.Add(c.waited)
+	}
+}
+
+func totalBytes(values []int64) int64 {
+	var total int64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// 持续传输时的速率等于配置的速率,开始时可以突发一个桶容量(一秒)的数据
+func TestBandwidthRateAccuracy(t *testing.T) {
+	const rate = 100_000
+	const duration = time.Minute
+	for _, dir := range []string{bandwidthUpload, bandwidthDownload} {
+		t.Run(dir, func(t *testing.T) {
+			s, c := newFakeClockShaper(BandwidthLimit{Upload: rate, Download: rate})
+			f := s.newFlow("192.0.2.1", upstreamAttempt{method: "direct"})
+			sent := simulateFlows(t, c, []*bandwidthFlow{f}, dir, duration)[0]
+
+			want := int64(rate + rate*duration/time.Second)
+			if sent < want || sent >= want+int64(f.chunk(dir)) {
+				t.Fatalf("sent %d bytes in %v, want %d (+ less than one chunk)", sent, duration, want)
+			}
+		})
+	}
+}
+
+// 同一个桶中持续传输的连接平分带宽,总速率不超过桶的速率,不同桶之间互不影响
+func TestBandwidthFairSharing(t *testing.T) {
+	const rate = 100_000
+	const duration = time.Minute
+	s, c := newFakeClockShaper(BandwidthLimit{Download: rate})
+	direct := upstreamAttempt{method: "direct"}
+	flows := []*bandwidthFlow{
+		s.newFlow("192.0.2.1", direct),
+		s.newFlow("192.0.2.1", direct),
+		s.newFlow("192.0.2.1", direct),
+		s.newFlow("192.0.2.2", direct),
+	}
+	sent := simulateFlows(t, c, flows, bandwidthDownload, duration)
+
+	chunk := int64(flows[0].chunk(bandwidthDownload))
+	want := int64(rate + rate*duration/time.Second)
+	shared := sent[:3]
+	// 结束时每个连接最多有一块还没有还清
+	if total := totalBytes(shared); total < want || total >= want+3*chunk {
+		t.Fatalf("connections sharing a bucket sent %d bytes in total, want %d", total, want)
+	}
+	for i, n := range shared {
+		if d := n - want/3; d > chunk || d < -chunk {
+			t.Fatalf("connection %d sent %d bytes, want %d ± one chunk (all: %v)", i, n, want/3, shared)
+		}
+	}
+	if sent[3] < want || sent[3] >= want+chunk {
+		t.Fatalf("connection of another client sent %d bytes, want %d", sent[3], want)
+	}
+}
+
+// 经过多个桶的连接受最慢的桶限制: 两个客户端共享规则的桶时各得到规则速率的一半
+func TestBandwidthRuleBucketShared(t *testing.T) {
+	const clientRate, ruleRate = 100_000, 40_000
+	const duration = time.Minute
+	s, c := newFakeClockShaper(BandwidthLimit{Download: clientRate})
+	rule := &Rule{DomainPattern: "*.example.com", Bandwidth: BandwidthLimit{Download: ruleRate}}
+	attempt := upstreamAttempt{method: "direct", rule: rule}
+	flows := []*bandwidthFlow{s.newFlow("192.0.2.1", attempt), s.newFlow("192.0.2.2", attempt)}
+	sent := simulateFlows(t, c, flows, bandwidthDownload, duration)
+
+	chunk := int64(flows[0].chunk(bandwidthDownload))
+	want := int64(ruleRate + ruleRate*duration/time.Second)
+	if total := totalBytes(sent); total < want || total >= want+2*chunk {
+		t.Fatalf("sent %d bytes in total through the rule bucket, want %d", total, want)
+	}
+	if d := sent[0] - sent[1]; d > chunk || d < -chunk {
+		t.Fatalf("clients sharing the rule bucket sent %v bytes, want equal ± one chunk", sent)
+	}
+}
+
+// 连接关闭时结束正在进行的等待
+func TestBandwidthWaitEndsOnClose(t *testing.T) {
+	s, _ := newFakeClockShaper(BandwidthLimit{Download: 1000})
+	s.after = func(time.Duration) <-chan time.Time { return nil }
+	f := s.newFlow("192.0.2.1", upstreamAttempt{method: "direct"})
+	if _, err := f.write(io.Discard, bandwidthDownload, make([]byte, 1000)); err != nil {
+		t.Fatalf("write within burst: %v", err)
+	}
+	f.close()
+	if _, err := f.write(io.Discard, bandwidthDownload, make([]byte, 1000)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after close: err = %v, want net.ErrClosed", err)
+	}
+}
+
+// 普通 HTTP 请求结束时结束请求的限速对象: 上游不读请求体就回复时,
+// 正在等待令牌的请求体不会让代理一直等下去
+func TestPlainHTTPReleasesShapedFlow(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\n\r\n")
+		io.Copy(io.Discard, conn)
+	})
+	withUpstreams(t, Config{})
+	oldShaper := trafficShaper
+	t.Cleanup(func() { trafficShaper = oldShaper })
+	// 需要等待令牌时一直等待,只有限速对象结束时才返回
+	trafficShaper = newBandwidthShaper(BandwidthLimit{Upload: 1000}, nil)
+	trafficShaper.after = func(time.Duration) <-chan time.Time { return nil }
+	proxy := startTestProxy(t)
+
+	conn := dialTestProxy(t, proxy)
+	io.WriteString(conn, "POST http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\nContent-Length: 1048576\r\n\r\n")
+	conn.Write(make([]byte, 3000))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %s, want 413", resp.Status)
+	}
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after response: err = %v, want EOF", err)
+	}
+	if d := time.Since(start); d > requestBodyWait+time.Second {
+		t.Fatalf("client connection closed after %v", d)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"net"
+)
+
+// bufferedConn 带读缓冲的连接
+// 解析请求头或响应头时 bufio.Reader 可能已经多读了后面的数据
+// (例如紧跟在 CONNECT 请求后面的 TLS ClientHello,或者上游在 200 之后立即发来的数据),
+// Read 会先返回这些已经缓存的数据,再从底层连接读取,转为隧道时不会丢失
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// newBufferedConn 包装 conn,conn 已经是 bufferedConn 时直接返回,保证同一个连接只有一个读缓冲
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc
+	}
+	return &bufferedConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+// newBufferedConnSize 和 newBufferedConn 相同,但是指定读缓冲的大小
+// 需要 Peek 较多数据(例如完整的 TLS ClientHello)时使用
+func newBufferedConnSize(conn net.Conn, size int) *bufferedConn {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc
+	}
+	return &bufferedConn{Conn: conn, br: bufio.NewReaderSize(conn, size)}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// Peek 查看接下来的 n 个字节但不消耗它们
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.br.Peek(n)
+}
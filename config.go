@@ -1,17 +1,585 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Rules []struct {
-		DomainPattern string `yaml:"domainPattern"`
-		ForwardMethod string `yaml:"forwardMethod"`
-	} `yaml:"rules"`
+	Rules []Rule `yaml:"rules"`
+
+	// 所有上游共用的健康检查配置,未配置的字段使用默认值
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+	// 按上游地址单独覆盖的配置
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	// 根据真实请求的失败情况熔断上游
+	CircuitBreaker CircuitBreaker `yaml:"circuitBreaker"`
+	// 连接上游失败时的重试
+	Retry Retry `yaml:"retry"`
+	// 上游域名的解析
+	UpstreamResolve UpstreamResolve `yaml:"upstreamResolve"`
+	// 普通 HTTP 客户端连接的复用
+	ClientKeepAlive ClientKeepAlive `yaml:"clientKeepAlive"`
+	// 普通 HTTP 转发的上游连接池
+	UpstreamPool UpstreamPool `yaml:"upstreamPool"`
+	// 普通 HTTP 转发时对请求头和响应头的处理,规则中可以单独覆盖
+	Headers HeaderPolicy `yaml:"headers"`
+	// SOCKS5 入站
+	Socks5 Socks5 `yaml:"socks5"`
+	// CONNECT 隧道按 TLS SNI 路由
+	ConnectSniff ConnectSniff `yaml:"connectSniff"`
+	// TLS 入站(-listen_tls)
+	TLS TLSInbound `yaml:"tls"`
+	// 额外的监听器,和命令行参数指定的监听器一起启动
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// 内置 DNS 服务
+	DNS DNSServer `yaml:"dns"`
+	// 直连时解析目标域名的解析器
+	Resolvers []ResolverConfig `yaml:"resolvers"`
+	// 直连默认使用的解析器名字,为空或者 system 时使用系统解析器,规则中可以单独指定
+	DirectResolver string `yaml:"directResolver"`
+	// HTTP 代理的 Basic 认证
+	ProxyAuth ProxyAuth `yaml:"proxyAuth"`
+	// 用户组: 组名 -> 用户名,规则和用户策略可以按组引用
+	Groups map[string][]string `yaml:"groups"`
+	// 按用户或用户组的路由策略,按顺序使用第一个匹配的
+	UserPolicies []UserPolicy `yaml:"userPolicies"`
+	// 按客户端 IP 的访问控制,在接受连接时检查,收到 SIGHUP 时重新加载
+	ACL ACL `yaml:"acl"`
+	// 并发连接数和新建连接速率的限制
+	Limits Limits `yaml:"limits"`
+	// 上传和下载的限速,规则和上游中可以单独配置
+	Bandwidth Bandwidth `yaml:"bandwidth"`
+}
+
+// Bandwidth 全局的限速配置
+type Bandwidth struct {
+	// 每个客户端 IP 的限速,同一个客户端的所有连接共用
+	PerClient BandwidthLimit `yaml:"perClient"`
+}
+
+// BandwidthLimit 上传和下载的速率,单位为字节/秒,0 表示不限速
+// 同一个限速对象的所有连接共用令牌桶,连接之间平分带宽
+type BandwidthLimit struct {
+	Upload   int64 `yaml:"upload"`   // 客户端发往目标
+	Download int64 `yaml:"download"` // 目标发往客户端
+}
+
+// Limits 并发连接数和新建连接速率的限制,为 0 的项不限制
+// 超过全局限制时 HTTP 回复 503,超过单个客户端的限制时回复 429,SOCKS 回复拒绝
+type Limits struct {
+	MaxConnections        int `yaml:"maxConnections"`        // 全局并发连接数
+	MaxConnectionsPerIP   int `yaml:"maxConnectionsPerIP"`   // 单个客户端 IP 的并发连接数
+	MaxConnectionsPerUser int `yaml:"maxConnectionsPerUser"` // 单个认证用户的并发请求和隧道数
+	// 全局每秒新建连接数,burst 为允许的突发连接数,为 0 时等于每秒连接数
+	ConnectionsPerSecond float64 `yaml:"connectionsPerSecond"`
+	Burst                int     `yaml:"burst"`
+	// 单个客户端 IP 每秒新建连接数
+	ConnectionsPerSecondPerIP float64 `yaml:"connectionsPerSecondPerIP"`
+	BurstPerIP                int     `yaml:"burstPerIP"`
+}
+
+// ACL 客户端 IP 访问控制,地址为 CIDR 或者单个 IP
+// 先检查 deny,再检查 allow;allow 为空时允许所有不在 deny 中的地址
+// unix socket 等没有 IP 的连接不受限制
+type ACL struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// 按监听器标签覆盖,配置了的监听器只使用这里的 allow / deny
+	Listeners map[string]ACL `yaml:"listeners"`
+}
+
+// UserPolicy 按用户(代理认证的用户名,没有时为 mTLS 证书的 CN)的路由策略
+type UserPolicy struct {
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+	// 没有匹配的规则时使用的转发方式 direct / proxy / block,
+	// 为空时使用全局的默认路由(内网和 IP 直连,其它走代理)
+	DefaultMethod string `yaml:"defaultMethod"`
+	// proxy 方式固定使用的上游,失败时不会换到其它上游,为空时按全局的上游选择
+	Upstream string `yaml:"upstream"`
+}
+
+// ProxyAuth HTTP 代理(CONNECT 和普通 HTTP)的 Proxy-Authorization: Basic 认证
+// 配置了 users 或 htpasswdFile 时要求认证,两者中的用户都可以使用
+type ProxyAuth struct {
+	Realm string      `yaml:"realm"` // Proxy-Authenticate 中的 realm
+	Users []ProxyUser `yaml:"users"`
+	// htpasswd 文件,只支持 bcrypt 格式的密码(htpasswd -B),文件修改后自动重新加载
+	HtpasswdFile string `yaml:"htpasswdFile"`
+	// 检查 htpasswd 文件是否修改的间隔
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+type ProxyUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ResolverConfig 直连使用的解析器
+// 同时查询 A 和 AAAA,按 TTL 缓存肯定和否定的结果
+type ResolverConfig struct {
+	Name string `yaml:"name"`
+	// DNS 服务器,依次尝试:
+	// host:port 或 udp://host:port,tcp://host:port,tls://host:port(DNS over TLS),https://host/path(DNS over HTTPS)
+	Servers   []string      `yaml:"servers"`
+	Timeout   time.Duration `yaml:"timeout"`   // 每个服务器的查询超时
+	CacheSize int           `yaml:"cacheSize"` // 最多缓存的响应数,0 使用默认值,小于 0 不缓存
+	// 没有 SOA 的否定响应(NXDOMAIN / 没有记录)的缓存时间
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+}
+
+// DNSServer 内置 DNS 服务配置
+// 按域名规则分流: direct 的域名直接查询 Direct 中的服务器,
+// proxy 的域名通过 proxy 上游 CONNECT 到 Proxy 中的服务器后使用 DNS over TCP 查询,block 的域名返回 NXDOMAIN
+type DNSServer struct {
+	Listen    string        `yaml:"listen"`    // UDP 和 TCP 的监听地址,为空时不启用
+	Tag       string        `yaml:"tag"`       // 监听器标签,规则可以通过 listeners 引用
+	Direct    []string      `yaml:"direct"`    // direct 域名使用的 DNS 服务器 host:port,依次尝试
+	Proxy     []string      `yaml:"proxy"`     // proxy 域名使用的 DNS 服务器 host:port,依次尝试
+	Timeout   time.Duration `yaml:"timeout"`   // 每个服务器的查询超时
+	CacheSize int           `yaml:"cacheSize"` // 最多缓存的响应数,0 使用默认值,小于 0 不缓存
+	// 没有 SOA 的否定响应(NXDOMAIN / 没有记录)的缓存时间
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+}
+
+// ListenerConfig 一个监听器
+type ListenerConfig struct {
+	// tcp(默认) / unix / systemd
+	Network string `yaml:"network"`
+	// tcp 为 [host]:port,unix 为 socket 文件路径,
+	// systemd 为 socket 单元中 FileDescriptorName 设置的名字或者继承的 fd 的序号(从 0 开始)
+	Addr string `yaml:"addr"`
+	// mixed(默认,自动识别 HTTP 和 SOCKS4/5) / socks5 / tls / transparent
+	Type string `yaml:"type"`
+	// 标签,规则可以通过 listeners 只对某些监听器生效,指标中也按标签区分
+	Tag string `yaml:"tag"`
+	// unix socket 文件的权限,例如 "0660",为空时使用 umask 决定的权限
+	Mode string `yaml:"mode"`
+}
+
+// TLSInbound TLS 入站配置
+// 证书和私钥文件都不存在时生成自签名证书并保存到这两个路径
+type TLSInbound struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// 配置后要求客户端提供由这些 CA 签发的证书(mTLS),证书的 CN 记录在日志中
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// ConnectSniff CONNECT 隧道的 SNI 嗅探配置
+// 开启后先回复 200,再根据 ClientHello 中的 SNI 决定直连、代理还是拦截,
+// 隧道的目标仍然是 CONNECT 中的地址,没有 SNI 时按 CONNECT 的 host 路由
+type ConnectSniff struct {
+	Enable bool `yaml:"enable"`
+	OnlyIP bool `yaml:"onlyIP"` // 只对目标是 IP 的 CONNECT 嗅探
+}
+
+// Socks5 SOCKS5 入站配置
+type Socks5 struct {
+	// 配置了用户或者 proxyAuth 时要求客户端使用用户名/密码认证(RFC 1929),否则不需要认证
+	Users []Socks5User `yaml:"users"`
+	// UDP ASSOCIATE
+	UDP Socks5UDP `yaml:"udp"`
+}
+
+// Socks5UDP SOCKS5 UDP 转发配置
+// UDP 无法通过 HTTP 上游的 CONNECT 转发,proxy 方式的数据报通过单独配置的 SOCKS5 上游转发
+type Socks5UDP struct {
+	Disable     bool          `yaml:"disable"`
+	IdleTimeout time.Duration `yaml:"idleTimeout"` // NAT 表项空闲多久后删除
+	Upstream    string        `yaml:"upstream"`    // SOCKS5 上游地址,为空时丢弃 proxy 方式的数据报
+	Username    string        `yaml:"username"`    // SOCKS5 上游的用户名,为空时不认证
+	Password    string        `yaml:"password"`
+}
+
+type Socks5User struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HeaderPolicy 普通 HTTP 转发时的头部处理
+// 字段为空表示使用上一级(全局配置或默认值)的设置
+type HeaderPolicy struct {
+	StripHopByHop *bool  `yaml:"stripHopByHop"` // 删除 RFC 7230 规定的 hop-by-hop 头部以及 Connection 中列出的头部,默认开启
+	Via           *bool  `yaml:"via"`           // 添加 Via 头
+	ViaName       string `yaml:"viaName"`       // Via 中使用的代理名
+	XForwardedFor *bool  `yaml:"xForwardedFor"` // 把客户端地址追加到 X-Forwarded-For
+	Forwarded     *bool  `yaml:"forwarded"`     // 添加 RFC 7239 Forwarded 头
+}
+
+// UpstreamPool 普通 HTTP 转发的上游连接池配置
+type UpstreamPool struct {
+	Disable        bool          `yaml:"disable"`
+	MaxIdle        int           `yaml:"maxIdle"`        // 所有目标合计最多保留的空闲连接
+	MaxIdlePerHost int           `yaml:"maxIdlePerHost"` // 每个目标(直连的 host:port 或 proxy 上游)最多保留的空闲连接
+	IdleTimeout    time.Duration `yaml:"idleTimeout"`    // 空闲连接的过期时间
+}
+
+// ClientKeepAlive 普通 HTTP 客户端长连接配置
+type ClientKeepAlive struct {
+	Disable     bool          `yaml:"disable"`     // 每个连接只处理一个请求
+	IdleTimeout time.Duration `yaml:"idleTimeout"` // 等待下一个请求的最长时间
+	MaxRequests int           `yaml:"maxRequests"` // 每个连接最多处理的请求数,0 表示不限制
+}
+
+type Rule struct {
+	DomainPattern string `yaml:"domainPattern"`
+	ForwardMethod string `yaml:"forwardMethod"`
+	// 所有 proxy 上游都连接失败时是否允许改为直连
+	FallbackDirect bool `yaml:"fallbackDirect"`
+	// 覆盖全局的头部处理配置
+	Headers HeaderPolicy `yaml:"headers"`
+	// 只对这些标签的监听器接受的连接生效,为空时对所有监听器生效
+	Listeners []string `yaml:"listeners"`
+	// 直连时使用的解析器名字,为空时使用全局的 directResolver,system 表示系统解析器
+	Resolver string `yaml:"resolver"`
+	// 只对这些用户或用户组的请求生效,都为空时对所有请求生效
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+	// 匹配这条规则的所有连接共用的限速
+	Bandwidth BandwidthLimit `yaml:"bandwidth"`
+}
+
+// Retry 连接上游失败时的重试配置
+// 只在还没有向客户端发送任何数据之前重试
+type Retry struct {
+	Attempts int           `yaml:"attempts"` // 最多尝试次数,包含第一次
+	Timeout  time.Duration `yaml:"timeout"`  // 每次尝试的超时(建立连接以及 CONNECT 握手)
+}
+
+// UpstreamResolve 上游域名解析配置
+type UpstreamResolve struct {
+	Interval      time.Duration `yaml:"interval"`      // 重新解析的间隔,解析结果带 TTL 时取两者中较小的
+	Prefer        string        `yaml:"prefer"`        // 优先使用的地址族 ipv4 / ipv6,为空时按解析结果的顺序
+	FallbackDelay time.Duration `yaml:"fallbackDelay"` // happy eyeballs 启动下一个连接前等待的时间
+	// 解析上游域名使用的解析器名字(resolvers 中配置),为空或者 system 时使用系统解析器,
+	// 系统解析器不提供 TTL,只按 interval 重新解析
+	Resolver string `yaml:"resolver"`
+}
+
+// CircuitBreaker 被动健康检查(熔断)配置
+type CircuitBreaker struct {
+	Failures int           `yaml:"failures"` // 连续失败多少次后熔断
+	Cooldown time.Duration `yaml:"cooldown"` // 熔断多久后放行一个探测请求(半开)
+}
+
+// HealthCheck 上游健康检查配置
+type HealthCheck struct {
+	// 探测方式: tcp(只建立TCP连接) connect(发送CONNECT并要求200) https(CONNECT后完成TLS握手并发送HEAD请求)
+	Kind string `yaml:"kind"`
+	// 探测目标,connect 和 https 方式使用,例如 https://www.google.com/
+	// https 方式下如果 scheme 是 http 则不做TLS握手,方便本地用桩服务器测试
+	URL string `yaml:"url"`
+	// 期望的状态码,0 表示只要收到响应就算成功
+	ExpectStatus       int           `yaml:"expectStatus"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	Rise               int           `yaml:"rise"` // 连续成功多少次后判定为健康
+	Fall               int           `yaml:"fall"` // 连续失败多少次后判定为异常
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"`
+}
+
+type UpstreamConfig struct {
+	Addr        string      `yaml:"addr"`
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+	// 经过这个上游的所有连接共用的限速
+	Bandwidth BandwidthLimit `yaml:"bandwidth"`
+}
+
+var defaultHealthCheck = HealthCheck{
+	Kind:     "https",
+	URL:      "https://www.google.com/",
+	Interval: 10 * time.Second,
+	Timeout:  10 * time.Second,
+	Rise:     1,
+	Fall:     1,
+}
+
+var defaultCircuitBreaker = CircuitBreaker{
+	Failures: 3,
+	Cooldown: 30 * time.Second,
+}
+
+func (c *Config) circuitBreaker() CircuitBreaker {
+	cb := defaultCircuitBreaker
+	if c.CircuitBreaker.Failures > 0 {
+		cb.Failures = c.CircuitBreaker.Failures
+	}
+	if c.CircuitBreaker.Cooldown > 0 {
+		cb.Cooldown = c.CircuitBreaker.Cooldown
+	}
+	return cb
+}
+
+var defaultRetry = Retry{
+	Attempts: 3,
+	Timeout:  10 * time.Second,
+}
+
+func (c *Config) retry() Retry {
+	r := defaultRetry
+	if c.Retry.Attempts > 0 {
+		r.Attempts = c.Retry.Attempts
+	}
+	if c.Retry.Timeout > 0 {
+		r.Timeout = c.Retry.Timeout
+	}
+	return r
+}
+
+var defaultUpstreamResolve = UpstreamResolve{
+	Interval:      60 * time.Second,
+	FallbackDelay: 300 * time.Millisecond,
+}
+
+func (c *Config) upstreamResolve() UpstreamResolve {
+	r := defaultUpstreamResolve
+	if c.UpstreamResolve.Interval > 0 {
+		r.Interval = c.UpstreamResolve.Interval
+	}
+	if c.UpstreamResolve.FallbackDelay > 0 {
+		r.FallbackDelay = c.UpstreamResolve.FallbackDelay
+	}
+	r.Prefer = c.UpstreamResolve.Prefer
+	r.Resolver = c.UpstreamResolve.Resolver
+	return r
+}
+
+var defaultClientKeepAlive = ClientKeepAlive{
+	IdleTimeout: 60 * time.Second,
+}
+
+func (c *Config) clientKeepAlive() ClientKeepAlive {
+	k := c.ClientKeepAlive
+	if k.IdleTimeout <= 0 {
+		k.IdleTimeout = defaultClientKeepAlive.IdleTimeout
+	}
+	return k
+}
+
+var defaultSocks5UDP = Socks5UDP{
+	IdleTimeout: 60 * time.Second,
+}
+
+func (c *Config) socks5UDP() Socks5UDP {
+	u := c.Socks5.UDP
+	if u.IdleTimeout <= 0 {
+		u.IdleTimeout = defaultSocks5UDP.IdleTimeout
+	}
+	return u
+}
+
+var defaultTLSInbound = TLSInbound{
+	CertFile: "proxy_cert.pem",
+	KeyFile:  "proxy_key.pem",
+}
+
+func (c *Config) tlsInbound() TLSInbound {
+	t := c.TLS
+	if t.CertFile == "" {
+		t.CertFile = defaultTLSInbound.CertFile
+	}
+	if t.KeyFile == "" {
+		t.KeyFile = defaultTLSInbound.KeyFile
+	}
+	return t
+}
+
+var defaultDNSServer = DNSServer{
+	Tag:         "dns",
+	Direct:      []string{"223.5.5.5:53"},
+	Proxy:       []string{"8.8.8.8:53"},
+	Timeout:     5 * time.Second,
+	CacheSize:   4096,
+	NegativeTTL: 60 * time.Second,
+}
+
+func (c *Config) dnsServer() DNSServer {
+	d := c.DNS
+	if d.Tag == "" {
+		d.Tag = defaultDNSServer.Tag
+	}
+	if len(d.Direct) == 0 {
+		d.Direct = defaultDNSServer.Direct
+	}
+	if len(d.Proxy) == 0 {
+		d.Proxy = defaultDNSServer.Proxy
+	}
+	if d.Timeout <= 0 {
+		d.Timeout = defaultDNSServer.Timeout
+	}
+	if d.CacheSize == 0 {
+		d.CacheSize = defaultDNSServer.CacheSize
+	}
+	if d.NegativeTTL <= 0 {
+		d.NegativeTTL = defaultDNSServer.NegativeTTL
+	}
+	return d
+}
+
+var defaultUpstreamPool = UpstreamPool{
+	MaxIdle:        100,
+	MaxIdlePerHost: 8,
+	IdleTimeout:    90 * time.Second,
+}
+
+func (c *Config) upstreamPool() UpstreamPool {
+	p := c.UpstreamPool
+	if p.MaxIdle <= 0 {
+		p.MaxIdle = defaultUpstreamPool.MaxIdle
+	}
+	if p.MaxIdlePerHost <= 0 {
+		p.MaxIdlePerHost = defaultUpstreamPool.MaxIdlePerHost
+	}
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = defaultUpstreamPool.IdleTimeout
+	}
+	return p
+}
+
+var (
+	enabled  = true
+	disabled = false
+)
+
+var defaultHeaderPolicy = HeaderPolicy{
+	StripHopByHop: &enabled,
+	Via:           &disabled,
+	ViaName:       "http_proxy",
+	XForwardedFor: &disabled,
+	Forwarded:     &disabled,
+}
+
+// merge 用 o 中设置过的字段覆盖 h
+func (h HeaderPolicy) merge(o HeaderPolicy) HeaderPolicy {
+	if o.StripHopByHop != nil {
+		h.StripHopByHop = o.StripHopByHop
+	}
+	if o.Via != nil {
+		h.Via = o.Via
+	}
+	if o.ViaName != "" {
+		h.ViaName = o.ViaName
+	}
+	if o.XForwardedFor != nil {
+		h.XForwardedFor = o.XForwardedFor
+	}
+	if o.Forwarded != nil {
+		h.Forwarded = o.Forwarded
+	}
+	return h
+}
+
+// headerPolicy 返回某条规则最终生效的头部处理配置: 默认值 < 全局配置 < 规则配置
+// rule 为 nil 表示没有匹配的规则
+func (c *Config) headerPolicy(rule *Rule) HeaderPolicy {
+	p := defaultHeaderPolicy.merge(c.Headers)
+	if rule != nil {
+		p = p.merge(rule.Headers)
+	}
+	return p
+}
+
+// merge 用 o 中非零值的字段覆盖 h
+func (h HealthCheck) merge(o HealthCheck) HealthCheck {
+	if o.Kind != "" {
+		h.Kind = o.Kind
+	}
+	if o.URL != "" {
+		h.URL = o.URL
+	}
+	if o.ExpectStatus != 0 {
+		h.ExpectStatus = o.ExpectStatus
+	}
+	if o.Interval > 0 {
+		h.Interval = o.Interval
+	}
+	if o.Timeout > 0 {
+		h.Timeout = o.Timeout
+	}
+	if o.Rise > 0 {
+		h.Rise = o.Rise
+	}
+	if o.Fall > 0 {
+		h.Fall = o.Fall
+	}
+	if o.InsecureSkipVerify {
+		h.InsecureSkipVerify = true
+	}
+	return h
+}
+
+// healthCheckFor 返回某个上游最终生效的健康检查配置: 默认值 < 全局配置 < 上游单独配置
+func (c *Config) healthCheckFor(addr string) HealthCheck {
+	hc := defaultHealthCheck.merge(c.HealthCheck)
+	for _, u := range c.Upstreams {
+		if u.Addr == addr {
+			hc = hc.merge(u.HealthCheck)
+		}
+	}
+	return hc
+}
+
+var defaultResolver = ResolverConfig{
+	Timeout:     5 * time.Second,
+	CacheSize:   1024,
+	NegativeTTL: 60 * time.Second,
+}
+
+func (c *Config) resolvers() []ResolverConfig {
+	list := make([]ResolverConfig, len(c.Resolvers))
+	for i, r := range c.Resolvers {
+		if r.Timeout <= 0 {
+			r.Timeout = defaultResolver.Timeout
+		}
+		if r.CacheSize == 0 {
+			r.CacheSize = defaultResolver.CacheSize
+		}
+		if r.NegativeTTL <= 0 {
+			r.NegativeTTL = defaultResolver.NegativeTTL
+		}
+		list[i] = r
+	}
+	return list
+}
+
+var defaultProxyAuth = ProxyAuth{
+	Realm:          "http_proxy",
+	ReloadInterval: 5 * time.Second,
+}
+
+func (c *Config) proxyAuth() ProxyAuth {
+	a := c.ProxyAuth
+	if a.Realm == "" {
+		a.Realm = defaultProxyAuth.Realm
+	}
+	if a.ReloadInterval <= 0 {
+		a.ReloadInterval = defaultProxyAuth.ReloadInterval
+	}
+	return a
+}
+
+// enabled 是否配置了任何限制
+func (l Limits) enabled() bool {
+	return l != Limits{}
+}
+
+// enabled 是否配置了任何方向的限速
+func (l BandwidthLimit) enabled() bool {
+	return l.Upload > 0 || l.Download > 0
+}
+
+// rate 返回 dir 方向的速率
+func (l BandwidthLimit) rate(dir string) int64 {
+	if dir == bandwidthUpload {
+		return l.Upload
+	}
+	return l.Download
 }
 
 var DomainForwardMap []struct {
@@ -20,15 +588,9 @@ var DomainForwardMap []struct {
 }
 
 func LoadConfig() Config {
-	data, err := os.ReadFile("config.yaml")
+	cfg, err := readConfig()
 	if err != nil {
-		logrus.Errorf("failed to read config file: %v", err)
-		return Config{}
-	}
-
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		logrus.Errorf("failed to parse config: %v", err)
+		logrus.Errorf("failed to load config: %v", err)
 		return Config{}
 	}
 	logrus.Debug("加载的配置:")
@@ -39,3 +601,17 @@ func LoadConfig() Config {
 
 	return cfg
 }
+
+// readConfig 读取并解析 config.yaml,重新加载部分配置时使用,出错时由调用方决定是否保留旧的配置
+func readConfig() (Config, error) {
+	data, err := os.ReadFile("config.yaml")
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to parse config: %v", err)
+	}
+	return cfg, nil
+}
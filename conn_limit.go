@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 超过限制的原因,也是指标中 limit 标签的值
+const (
+	limitGlobal    = "global"      // 全局并发连接数
+	limitPerIP     = "per_ip"      // 单个客户端 IP 的并发连接数
+	limitPerUser   = "per_user"    // 单个认证用户的并发请求和隧道数
+	limitRate      = "rate"        // 全局新建连接速率
+	limitRatePerIP = "rate_per_ip" // 单个客户端 IP 的新建连接速率
+)
+
+const (
+	// 超过限制的连接在这段时间内读取请求并回复错误,之后直接关闭
+	limitRejectTimeout = 5 * time.Second
+	// 同时处理的超限连接的最大数量,超过时不回复直接关闭,避免被拒绝的连接本身占用大量 goroutine
+	limitMaxRejecting = 64
+	// 清理已经回满的单 IP 令牌桶的间隔
+	limitPruneInterval = time.Minute
+)
+
+// 当前正在回复错误的超限连接数
+var limitRejecting atomic.Int32
+
+// 超过限制时连接的 ctx 中带有原因,处理函数读取请求后回复错误
+const limitRejectKey contextKey = "limitReject"
+
+// connLimits 为 nil 时不限制
+var connLimits *connLimiter
+
+// connLimiter 并发连接数和新建连接速率的限制,配置为 0 的项不限制
+type connLimiter struct {
+	cfg Limits
+	now func() time.Time
+
+	mu        sync.Mutex
+	total     int
+	perIP     map[string]int
+	perUser   map[string]int
+	rate      *tokenBucket
+	ipRates   map[string]*tokenBucket
+	lastPrune time.Time
+	// 最近一秒内新建的连接数,用于指标
+	window      time.Time
+	windowCount int
+}
+
+// tokenBucket 令牌桶,每秒补充 rate 个令牌,最多保存 burst 个
+// 不加锁,由使用者保证互斥
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// refill 按经过的时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// allow 有令牌时取走一个并返回 true
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve 取走 n 个令牌,令牌不足时允许欠账,返回还清欠账需要等待的时间
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func newConnLimiter(cfg Limits) *connLimiter {
+	l := &connLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		perIP:   make(map[string]int),
+		perUser: make(map[string]int),
+		ipRates: make(map[string]*tokenBucket),
+	}
+	now := l.now()
+	if cfg.ConnectionsPerSecond > 0 {
+		l.rate = newTokenBucket(cfg.ConnectionsPerSecond, cfg.Burst, now)
+	}
+	l.lastPrune, l.window = now, now
+
+	connectionLimit.WithLabelValues(limitGlobal).Set(float64(cfg.MaxConnections))
+	connectionLimit.WithLabelValues(limitPerIP).Set(float64(cfg.MaxConnectionsPerIP))
+	connectionLimit.WithLabelValues(limitPerUser).Set(float64(cfg.MaxConnectionsPerUser))
+	connectionLimit.WithLabelValues(limitRate).Set(cfg.ConnectionsPerSecond)
+	connectionLimit.WithLabelValues(limitRatePerIP).Set(cfg.ConnectionsPerSecondPerIP)
+	return l
+}
+
+// acquireConn 在接受连接时检查全局和客户端 IP 的限制
+// 没有超过限制时返回释放函数,超过时返回原因;ip 为空(unix socket 等)时不检查单 IP 的限制
+func (l *connLimiter) acquireConn(ip string) (release func(), reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.pruneLocked(now)
+
+	switch {
+	case l.cfg.MaxConnections > 0 && l.total >= l.cfg.MaxConnections:
+		return nil, limitGlobal
+	case ip != "" && l.cfg.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.cfg.MaxConnectionsPerIP:
+		return nil, limitPerIP
+	}
+	// 并发数没有超过限制时才消耗令牌,被拒绝的连接不占用速率
+	if ip != "" && l.cfg.ConnectionsPerSecondPerIP > 0 {
+		b := l.ipRates[ip]
+		if b == nil {
+			b = newTokenBucket(l.cfg.ConnectionsPerSecondPerIP, l.cfg.BurstPerIP, now)
+			l.ipRates[ip] = b
+		}
+		if !b.allow(now) {
+			return nil, limitRatePerIP
+		}
+	}
+	if l.rate != nil && !l.rate.allow(now) {
+		return nil, limitRate
+	}
+
+	l.total++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	l.countNewLocked(now)
+	l.updateUsageLocked()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if ip != "" {
+				if l.perIP[ip]--; l.perIP[ip] <= 0 {
+					delete(l.perIP, ip)
+				}
+			}
+			l.updateUsageLocked()
+		})
+	}, ""
+}
+
+// acquireUser 检查认证用户的并发限制,没有超过时返回释放函数,超过时返回 nil
+// 没有认证的请求(user 为空)不限制
+func (l *connLimiter) acquireUser(user string) func() {
+	if user == "" {
+		return func() {}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxConnectionsPerUser > 0 && l.perUser[user] >= l.cfg.MaxConnectionsPerUser {
+		return nil
+	}
+	l.perUser[user]++
+	l.updateUsageLocked()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.perUser[user]--; l.perUser[user] <= 0 {
+				delete(l.perUser, user)
+			}
+			l.updateUsageLocked()
+		})
+	}
+}
+
+// countNewLocked 统计最近一秒内新建的连接数
+func (l *connLimiter) countNewLocked(now time.Time) {
+	if elapsed := now.Sub(l.window); elapsed >= time.Second {
+		// 超过两秒没有新连接时上一秒的连接数为 0
+		last := l.windowCount
+		if elapsed >= 2*time.Second {
+			last = 0
+		}
+		connectionLimitUsage.WithLabelValues(limitRate).Set(float64(last))
+		l.window, l.windowCount = now, 0
+	}
+	l.windowCount++
+}
+
+// updateUsageLocked 更新当前用量的指标,单 IP 和单用户的用量取所有客户端中最大的
+func (l *connLimiter) updateUsageLocked() {
+	connectionLimitUsage.WithLabelValues(limitGlobal).Set(float64(l.total))
+	connectionLimitUsage.WithLabelValues(limitPerIP).Set(float64(maxCount(l.perIP)))
+	connectionLimitUsage.WithLabelValues(limitPerUser).Set(float64(maxCount(l.perUser)))
+}
+
+func maxCount(m map[string]int) int {
+	n := 0
+	for _, v := range m {
+		n = max(n, v)
+	}
+	return n
+}
+
+// pruneLocked 定期删除已经回满的单 IP 令牌桶,回满的桶和新建的桶没有区别
+func (l *connLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < limitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for ip, b := range l.ipRates {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.ipRates, ip)
+		}
+	}
+}
+
+// limitRejection 返回连接超过的限制,没有超过时返回空字符串
+func limitRejection(ctx context.Context) string {
+	reason, _ := ctx.Value(limitRejectKey).(string)
+	return reason
+}
+
+// limitStatus 超过全局限制时服务端过载,返回 503,超过单个客户端的限制时返回 429
+func limitStatus(reason string) int {
+	if reason == limitGlobal || reason == limitRate {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// writeLimitResponse 回复超过限制的 HTTP 错误,回复后关闭连接
+func writeLimitResponse(conn net.Conn, reason string) error {
+	status := limitStatus(reason)
+	_, err := conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n" +
+		"Retry-After: 1\r\n" +
+		"Content-Length: 0\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"))
+	return err
+}
+
+// clientIP 返回连接的客户端 IP,没有 IP 的连接返回空字符串
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap().String()
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap().String()
+	}
+	return ""
+}
+
+// acquireUserLimit 检查 ctx 中认证用户的并发限制,没有超过时返回释放函数,超过时返回 nil
+func acquireUserLimit(ctx context.Context) func() {
+	if connLimits == nil {
+		return func() {}
+	}
+	user := requestUser(ctx)
+	release := connLimits.acquireUser(user)
+	if release == nil {
+		requestLogger(ctx).Warnf("用户 %q 超过并发限制", user)
+		connectionLimitRejected.WithLabelValues(limitPerUser).Inc()
+	}
+	return release
+}
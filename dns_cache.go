@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsCache 按 名字/类型/类 缓存 DNS 响应
+// 返回缓存的响应时按已经经过的时间减少 TTL
+type dnsCache struct {
+	name        string // 指标中区分不同缓存的名字
+	size        int
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	method  string
+	stored  time.Time
+	expires time.Time
+}
+
+// newDNSCache size 小于等于 0 时不缓存
+func newDNSCache(name string, size int, negativeTTL time.Duration) *dnsCache {
+	return &dnsCache{name: name, size: size, negativeTTL: negativeTTL, now: time.Now, entries: make(map[string]*dnsCacheEntry)}
+}
+
+// get 返回缓存的响应,ID 改为 id
+func (c *dnsCache) get(key string, id uint16) ([]byte, string, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	now := c.now()
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, key)
+		dnsCacheEntries.WithLabelValues(c.name).Set(float64(len(c.entries)))
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	msg := e.msg
+	msg.Header.ID = id
+	msg.Answers = agedResources(e.msg.Answers, elapsed)
+	msg.Authorities = agedResources(e.msg.Authorities, elapsed)
+	msg.Additionals = agedResources(e.msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, "", false
+	}
+	return b, e.method, true
+}
+
+// agedResources 复制 rrs 并把 TTL 减去 elapsed,OPT 记录的 TTL 字段不是 TTL,保持不变
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if rrs == nil {
+		return nil
+	}
+	aged := make([]dnsmessage.Resource, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			if rr.Header.TTL > elapsed {
+				rr.Header.TTL -= elapsed
+			} else {
+				rr.Header.TTL = 0
+			}
+		}
+		aged[i] = rr
+	}
+	return aged
+}
+
+// put 缓存一个响应,缓存时间为记录中最小的 TTL
+// 否定响应(NXDOMAIN 或者没有记录)使用 SOA 的 minimum,没有 SOA 时使用 negativeTTL
+func (c *dnsCache) put(key, method string, resp []byte) {
+	if c.size <= 0 {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Header.Truncated || (msg.Header.RCode != dnsmessage.RCodeSuccess && msg.Header.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	var ttl uint32
+	found := false
+	minTTL := func(t uint32) {
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	for _, rr := range msg.Answers {
+		minTTL(rr.Header.TTL)
+	}
+	if len(msg.Answers) == 0 {
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				minTTL(min(rr.Header.TTL, soa.MinTTL))
+			}
+		}
+		if !found {
+			minTTL(uint32(c.negativeTTL / time.Second))
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evictLocked(now)
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, method: method, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	dnsCacheEntries.WithLabelValues(c.name).Set(float64(len(c.entries)))
+}
+
+// evictLocked 删除过期的表项,仍然没有空间时随机删除一个
+func (c *dnsCache) evictLocked(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.size {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestDNSCache 返回使用假时钟的缓存,修改 *now 即可让时间前进
+func newTestDNSCache(size int) (*dnsCache, *time.Time) {
+	now := time.Unix(1_700_000_000, 0)
+	c := newDNSCache("test", size, time.Minute)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+// packDNSResponse 生成 cache.test. 的 A 查询的响应
+func packDNSResponse(t *testing.T, hdr dnsmessage.Header, answers, authorities []dnsmessage.Resource) []byte {
+	t.Helper()
+	hdr.Response = true
+	msg := dnsmessage.Message{
+		Header:      hdr,
+		Questions:   []dnsmessage.Question{{Name: dnsmessage.MustNewName("cache.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func aRecord(ttl uint32, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("cache.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func soaRecord(ttl, minTTL uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: minTTL,
+		},
+	}
+}
+
+// 缓存的响应按经过的时间减少 TTL,到期后不再返回
+func TestDNSCacheTTLExpiry(t *testing.T) {
+	c, now := newTestDNSCache(16)
+	resp := packDNSResponse(t, dnsmessage.Header{ID: 1}, []dnsmessage.Resource{
+		aRecord(300, [4]byte{192, 0, 2, 1}),
+		aRecord(30, [4]byte{192, 0, 2, 2}),
+	}, nil)
+	c.put("cache.test/A/IN", "direct", resp)
+
+	steps := []struct {
+		elapsed time.Duration
+		hit     bool
+		ttls    []uint32
+	}{
+		{0, true, []uint32{300, 30}},
+		{10 * time.Second, true, []uint32{290, 20}},
+		{29*time.Second + 900*time.Millisecond, true, []uint32{271, 1}},
+		// 缓存时间为最小的 TTL
+		{30 * time.Second, false, nil},
+		{29 * time.Second, false, nil}, // 过期的表项已经删除
+	}
+	start := *now
+	for _, s := range steps {
+		*now = start.Add(s.elapsed)
+		b, method, ok := c.get("cache.test/A/IN", 77)
+		if ok != s.hit {
+			t.Fatalf("after %v: hit = %v, want %v", s.elapsed, ok, s.hit)
+		}
+		if !ok {
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.ID != 77 || method != "direct" {
+			t.Fatalf("after %v: id = %d method = %q, want 77 direct", s.elapsed, msg.Header.ID, method)
+		}
+		for i, rr := range msg.Answers {
+			if rr.Header.TTL != s.ttls[i] {
+				t.Fatalf("after %v: answer %d TTL = %d, want %d", s.elapsed, i, rr.Header.TTL, s.ttls[i])
+			}
+		}
+	}
+}
+
+func TestDNSCacheCachingTime(t *testing.T) {
+	tests := []struct {
+		name string
+		resp func(t *testing.T) []byte
+		want time.Duration // 0 表示不缓存
+	}{
+		{"positive", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{}, []dnsmessage.Resource{aRecord(45, [4]byte{192, 0, 2, 1})}, nil)
+		}, 45 * time.Second},
+		{"nxdomain with soa", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{RCode: dnsmessage.RCodeNameError}, nil, []dnsmessage.Resource{soaRecord(600, 120)})
+		}, 120 * time.Second},
+		{"soa ttl below minimum", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{}, nil, []dnsmessage.Resource{soaRecord(15, 120)})
+		}, 15 * time.Second},
+		{"nodata without soa", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{}, nil, nil)
+		}, time.Minute},
+		{"zero ttl", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{}, []dnsmessage.Resource{aRecord(0, [4]byte{192, 0, 2, 1})}, nil)
+		}, 0},
+		{"servfail", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}, nil, nil)
+		}, 0},
+		{"truncated", func(t *testing.T) []byte {
+			return packDNSResponse(t, dnsmessage.Header{Truncated: true}, []dnsmessage.Resource{aRecord(45, [4]byte{192, 0, 2, 1})}, nil)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, now := newTestDNSCache(16)
+			start := *now
+			c.put("k", "direct", tt.resp(t))
+			if tt.want == 0 {
+				if _, _, ok := c.get("k", 1); ok {
+					t.Fatal("response was cached")
+				}
+				return
+			}
+			*now = start.Add(tt.want - time.Second)
+			if _, _, ok := c.get("k", 1); !ok {
+				t.Fatalf("miss before %v", tt.want)
+			}
+			*now = start.Add(tt.want)
+			if _, _, ok := c.get("k", 1); ok {
+				t.Fatalf("hit after %v", tt.want)
+			}
+		})
+	}
+}
+
+// 缓存已满时先删除过期的表项
+func TestDNSCacheEvictsExpiredFirst(t *testing.T) {
+	c, now := newTestDNSCache(2)
+	c.put("short", "direct", packDNSResponse(t, dnsmessage.Header{}, []dnsmessage.Resource{aRecord(10, [4]byte{192, 0, 2, 1})}, nil))
+	c.put("long", "direct", packDNSResponse(t, dnsmessage.Header{}, []dnsmessage.Resource{aRecord(600, [4]byte{192, 0, 2, 2})}, nil))
+	*now = now.Add(20 * time.Second)
+	c.put("new", "direct", packDNSResponse(t, dnsmessage.Header{}, []dnsmessage.Resource{aRecord(600, [4]byte{192, 0, 2, 3})}, nil))
+
+	for key, want := range map[string]bool{"short": false, "long": true, "new": true} {
+		if _, _, ok := c.get(key, 1); ok != want {
+			t.Errorf("get(%s) hit = %v, want %v", key, ok, want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DNS over HTTPS 的消息类型(RFC 8484)
+const dnsMessageContentType = "application/dns-message"
+
+// newDNSExchanger 按服务器地址的 scheme 创建查询单个服务器的 dnsExchanger
+//
+//	host:port 或 udp://host:port  UDP,响应被截断时改用 TCP,默认端口 53
+//	tcp://host:port               TCP,默认端口 53
+//	tls://host:port               DNS over TLS,默认端口 853,使用 host 验证证书
+//	https://host/path             DNS over HTTPS
+func newDNSExchanger(server string, timeout time.Duration) (dnsExchanger, error) {
+	scheme, addr, ok := strings.Cut(server, "://")
+	if !ok {
+		scheme, addr = "udp", server
+	}
+	switch scheme {
+	case "udp":
+		return &udpDNSExchanger{server: withDefaultPort(addr, "53"), timeout: timeout}, nil
+	case "tcp":
+		return &tcpDNSExchanger{server: withDefaultPort(addr, "53"), timeout: timeout}, nil
+	case "tls":
+		addr = withDefaultPort(addr, "853")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsDNSExchanger{server: addr, config: &tls.Config{ServerName: host}, timeout: timeout}, nil
+	case "https":
+		if _, err := url.Parse(server); err != nil {
+			return nil, err
+		}
+		return newHTTPSDNSExchanger(server, timeout), nil
+	}
+	return nil, fmt.Errorf("unknown DNS server scheme %q", scheme)
+}
+
+// withDefaultPort addr 没有端口时加上 port
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return joinHostPort(addr, port)
+}
+
+// udpDNSExchanger 使用 UDP 查询,响应被截断时改用 TCP
+type udpDNSExchanger struct {
+	server  string
+	timeout time.Duration
+}
+
+func (u *udpDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := u.exchangeUDP(ctx, query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// TC 标志
+		return (&tcpDNSExchanger{server: u.server, timeout: u.timeout}).exchange(ctx, query)
+	}
+	return resp, err
+}
+
+func (u *udpDNSExchanger) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	d := net.Dialer{Timeout: u.timeout}
+	conn, err := d.DialContext(ctx, "udp", u.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(u.timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不匹配的响应(可能是之前超时的查询的响应或者伪造的响应)
+		if checkDNSResponseID(query, buf[:n]) == nil {
+			return buf[:n], nil
+		}
+	}
+}
+
+// tcpDNSExchanger 使用 DNS over TCP 查询,每次查询建立一个新的连接
+type tcpDNSExchanger struct {
+	server  string
+	timeout time.Duration
+}
+
+func (t *tcpDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := net.Dialer{Timeout: t.timeout}
+	conn, err := d.DialContext(ctx, "tcp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	return dnsTCPExchange(conn, query)
+}
+
+// tlsDNSExchanger 使用 DNS over TLS(RFC 7858)查询,每次查询建立一个新的连接
+type tlsDNSExchanger struct {
+	server  string
+	config  *tls.Config // ServerName 为地址中的 host,用来验证证书
+	timeout time.Duration
+}
+
+func (t *tlsDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: t.timeout},
+		Config:    t.config,
+	}
+	conn, err := d.DialContext(ctx, "tcp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	return dnsTCPExchange(conn, query)
+}
+
+// httpsDNSExchanger 使用 DNS over HTTPS(RFC 8484)的 POST 方式查询
+// 直接连接 DoH 服务器,不使用环境变量中的代理
+type httpsDNSExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSDNSExchanger(url string, timeout time.Duration) *httpsDNSExchanger {
+	return &httpsDNSExchanger{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:             nil,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		},
+	}
+}
+
+func (h *httpsDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, udpBufferSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponseID(query, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
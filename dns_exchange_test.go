@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var exchangeZone = stubZone{ttl: 60, addrs: map[string][]string{"dns.test": {"192.0.2.53"}}}
+
+func TestNewDNSExchanger(t *testing.T) {
+	tests := []struct {
+		server     string
+		wantType   string
+		wantAddr   string
+		wantErr    bool
+		serverName string
+	}{
+		{server: "192.0.2.1", wantType: "udp", wantAddr: "192.0.2.1:53"},
+		{server: "udp://[2001:db8::1]", wantType: "udp", wantAddr: "[2001:db8::1]:53"},
+		{server: "192.0.2.1:5353", wantType: "udp", wantAddr: "192.0.2.1:5353"},
+		{server: "tcp://192.0.2.1", wantType: "tcp", wantAddr: "192.0.2.1:53"},
+		{server: "tls://dns.example", wantType: "tls", wantAddr: "dns.example:853", serverName: "dns.example"},
+		{server: "tls://192.0.2.1:8853", wantType: "tls", wantAddr: "192.0.2.1:8853", serverName: "192.0.2.1"},
+		{server: "https://dns.example/dns-query", wantType: "https", wantAddr: "https://dns.example/dns-query"},
+		{server: "quic://dns.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			ex, err := newDNSExchanger(tt.server, time.Second)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newDNSExchanger succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var typ, addr string
+			switch e := ex.(type) {
+			case *udpDNSExchanger:
+				typ, addr = "udp", e.server
+			case *tcpDNSExchanger:
+				typ, addr = "tcp", e.server
+			case *tlsDNSExchanger:
+				typ, addr = "tls", e.server
+				if e.config.ServerName != tt.serverName {
+					t.Errorf("ServerName = %q, want %q", e.config.ServerName, tt.serverName)
+				}
+			case *httpsDNSExchanger:
+				typ, addr = "https", e.url
+			}
+			if typ != tt.wantType || addr != tt.wantAddr {
+				t.Fatalf("exchanger = %s %s, want %s %s", typ, addr, tt.wantType, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// listenUDPAndTCP 在同一个端口上监听 UDP 和 TCP
+func listenUDPAndTCP(t *testing.T) (net.PacketConn, net.Listener) {
+	t.Helper()
+	for range 10 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", l.Addr().String())
+		if err == nil {
+			t.Cleanup(func() {
+				pc.Close()
+				l.Close()
+			})
+			return pc, l
+		}
+		l.Close()
+	}
+	t.Fatal("no free port for both UDP and TCP")
+	return nil, nil
+}
+
+// UDP 响应被截断时改用 TCP;ID 不匹配的 UDP 响应被忽略
+func TestUDPDNSExchanger(t *testing.T) {
+	pc, l := listenUDPAndTCP(t)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := exchangeZone.answer(t, buf[:n])
+			// 先发送一个 ID 不匹配的响应
+			bogus := append([]byte{}, resp...)
+			bogus[0] ^= 0xff
+			pc.WriteTo(bogus, addr)
+			var q dnsmessage.Message
+			q.Unpack(buf[:n])
+			if q.Questions[0].Type == dnsmessage.TypeAAAA {
+				// AAAA 查询回复截断的响应,要求客户端改用 TCP
+				resp[2] |= 0x02
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	var tcpQueries atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if query, err := readDNSTCP(conn); err == nil {
+				tcpQueries.Add(1)
+				writeDNSTCP(conn, exchangeZone.answer(t, query))
+			}
+			conn.Close()
+		}
+	}()
+
+	ex := &udpDNSExchanger{server: pc.LocalAddr().String(), timeout: 2 * time.Second}
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		resp, err := ex.exchange(context.Background(), newDNSQuery(t, "dns.test", typ, 42))
+		if err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		rcode, tc, addrs := dnsAnswer(t, resp)
+		if rcode != dnsmessage.RCodeSuccess || tc {
+			t.Fatalf("%s: rcode = %v truncated = %v", typ, rcode, tc)
+		}
+		if typ == dnsmessage.TypeA && (len(addrs) != 1 || addrs[0] != "192.0.2.53") {
+			t.Fatalf("A answer = %v", addrs)
+		}
+	}
+	if n := tcpQueries.Load(); n != 1 {
+		t.Fatalf("tcp queries = %d, want 1 (only the truncated AAAA)", n)
+	}
+}
+
+func TestHTTPSDNSExchanger(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageContentType || r.URL.Path != "/dns-query" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		resp := exchangeZone.answer(t, query)
+		var q dnsmessage.Message
+		q.Unpack(query)
+		if q.Questions[0].Name.String() == "bad-id.test." {
+			resp[0] ^= 0xff
+		}
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	newExchanger := func(path string) *httpsDNSExchanger {
+		ex := newHTTPSDNSExchanger(srv.URL+path, 2*time.Second)
+		ex.client.Transport.(*http.Transport).TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+		return ex
+	}
+	tests := []struct {
+		name    string
+		path    string
+		host    string
+		wantErr string
+	}{
+		{"ok", "/dns-query", "dns.test", ""},
+		{"http error", "/wrong-path", "dns.test", "400"},
+		{"mismatched id", "/dns-query", "bad-id.test", "mismatched"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newExchanger(tt.path).exchange(context.Background(), newDNSQuery(t, tt.host, dnsmessage.TypeA, 9))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, addrs := dnsAnswer(t, resp); len(addrs) != 1 || addrs[0] != "192.0.2.53" {
+				t.Fatalf("answer = %v", addrs)
+			}
+		})
+	}
+}
+
+func TestTLSDNSExchanger(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := loadOrCreateCert(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if query, err := readDNSTCP(conn); err == nil {
+					writeDNSTCP(conn, exchangeZone.answer(t, query))
+				}
+			}()
+		}
+	}()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trusted := range []bool{true, false} {
+		ex, err := newDNSExchanger("tls://"+ln.Addr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trusted {
+			pool := x509.NewCertPool()
+			pool.AddCert(leaf)
+			ex.(*tlsDNSExchanger).config.RootCAs = pool
+		}
+		resp, err := ex.exchange(context.Background(), newDNSQuery(t, "dns.test", dnsmessage.TypeA, 5))
+		if !trusted {
+			// 证书不受信任时握手失败
+			if err == nil {
+				t.Fatal("exchange with an untrusted certificate succeeded")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, addrs := dnsAnswer(t, resp); len(addrs) != 1 || addrs[0] != "192.0.2.53" {
+			t.Fatalf("answer = %v", addrs)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// 没有 EDNS 时 UDP 响应的最大长度
+	dnsMaxUDPSize = 512
+	// TCP 客户端连接的空闲超时
+	dnsTCPIdleTimeout = 30 * time.Second
+	// 同时处理的 UDP 查询数,超过时暂停读取,多出的查询留在 socket 的接收缓冲中
+	dnsMaxUDPWorkers = 256
+	// 通过 proxy 查询时每个 DNS 服务器最多保留的空闲隧道数和空闲时间
+	dnsTunnelMaxIdle     = 4
+	dnsTunnelIdleTimeout = 10 * time.Second
+)
+
+// dnsUDPBuffers 读取 UDP 查询使用的缓冲
+var dnsUDPBuffers = sync.Pool{New: func() any {
+	b := make([]byte, udpBufferSize)
+	return &b
+}}
+
+// dnsExchanger 把查询发给一组 DNS 服务器并返回原始响应
+// 按转发方式(direct / proxy)各有一个实现,测试时可以替换为桩服务器
+type dnsExchanger interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// dnsServer 内置 DNS 服务,按域名规则把查询分流到 direct 或 proxy 的 DNS 服务器
+type dnsServer struct {
+	cfg        DNSServer
+	exchangers map[string]dnsExchanger
+	cache      *dnsCache
+}
+
+func newDNSServer(cfg DNSServer) *dnsServer {
+	return &dnsServer{
+		cfg: cfg,
+		exchangers: map[string]dnsExchanger{
+			"direct": &directDNSExchanger{servers: cfg.Direct, timeout: cfg.Timeout},
+			"proxy":  &proxyDNSExchanger{servers: cfg.Proxy, timeout: cfg.Timeout},
+		},
+		cache: newDNSCache("dns", cfg.CacheSize, cfg.NegativeTTL),
+	}
+}
+
+// start 在同一个地址上监听 UDP 和 TCP
+func (s *dnsServer) start() error {
+	pc, err := net.ListenPacket("udp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go s.serveUDP(pc)
+	go s.serveTCP(l)
+	return nil
+}
+
+func (s *dnsServer) newContext() context.Context {
+	ctx := context.WithValue(context.Background(), requestIDKey, uuid.New().String())
+	return context.WithValue(ctx, listenerTagKey, s.cfg.Tag)
+}
+
+func (s *dnsServer) serveUDP(pc net.PacketConn) {
+	workers := make(chan struct{}, dnsMaxUDPWorkers)
+	for {
+		workers <- struct{}{}
+		bufp := dnsUDPBuffers.Get().(*[]byte)
+		release := func() {
+			dnsUDPBuffers.Put(bufp)
+			<-workers
+		}
+		buf := *bufp
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			release()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if reason := aclReject(s.cfg.Tag, addr); reason != "" {
+			listenerRejectedConnections.WithLabelValues(s.cfg.Tag, reason).Inc()
+			release()
+			continue
+		}
+		go func() {
+			defer release()
+			ctx := s.newContext()
+			resp := s.handle(ctx, buf[:n])
+			if resp == nil {
+				return
+			}
+			resp = truncateDNSResponse(buf[:n], resp)
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				requestLogger(ctx).Debugf("DNS 响应发送失败: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if reason := aclReject(s.cfg.Tag, conn.RemoteAddr()); reason != "" {
+			listenerRejectedConnections.WithLabelValues(s.cfg.Tag, reason).Inc()
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+				query, err := readDNSTCP(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(s.newContext(), query)
+				if resp == nil {
+					return
+				}
+				if err := writeDNSTCP(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle 处理一个查询,返回响应;查询无法解析时返回 nil
+func (s *dnsServer) handle(ctx context.Context, query []byte) []byte {
+	log := requestLogger(ctx)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		log.Debugf("无效的 DNS 查询: %v", err)
+		if err != nil {
+			return nil
+		}
+		return dnsReply(msg, dnsmessage.RCodeFormatError)
+	}
+	q := msg.Questions[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	key := name + "/" + q.Type.String() + "/" + q.Class.String()
+
+	if resp, method, ok := s.cache.get(key, msg.Header.ID); ok {
+		log.Debugf("DNS 查询 %s %s 命中缓存", name, q.Type)
+		dnsQueries.WithLabelValues(method, "hit").Inc()
+		return resp
+	}
+
+	_, method := getForwardMethodForHost(ctx, upstreams.pick(), name, "53", "dns")
+	dnsQueries.WithLabelValues(method, "miss").Inc()
+	ex, ok := s.exchangers[method]
+	if !ok {
+		// block
+		return dnsReply(msg, dnsmessage.RCodeNameError)
+	}
+	start := time.Now()
+	resp, err := ex.exchange(ctx, query)
+	if err != nil {
+		log.Errorf("DNS 查询 %s %s 失败: %v", name, q.Type, err)
+		dnsUpstreamErrors.WithLabelValues(method).Inc()
+		return dnsReply(msg, dnsmessage.RCodeServerFailure)
+	}
+	dnsUpstreamDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	s.cache.put(key, method, resp)
+	return resp
+}
+
+// dnsReply 生成只包含问题部分的响应
+func dnsReply(query dnsmessage.Message, rcode dnsmessage.RCode) []byte {
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			OpCode:             query.Header.OpCode,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+	}
+	b, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// truncateDNSResponse 响应超过客户端能接收的 UDP 大小时,返回设置了 TC 标志的空响应,客户端会改用 TCP 重试
+func truncateDNSResponse(query, resp []byte) []byte {
+	limit := dnsMaxUDPSize
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err == nil {
+		for _, rr := range q.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) > limit {
+				limit = int(rr.Header.Class)
+			}
+		}
+	}
+	if len(resp) <= limit {
+		return resp
+	}
+	var r dnsmessage.Message
+	if err := r.Unpack(resp); err != nil {
+		return resp
+	}
+	r.Header.Truncated = true
+	r.Answers, r.Authorities, r.Additionals = nil, nil, nil
+	if b, err := r.Pack(); err == nil {
+		return b
+	}
+	return resp
+}
+
+// readDNSTCP 读取一个带 2 字节长度前缀的 DNS 消息
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// dnsTCPExchange 在 conn 上使用 DNS over TCP 发送一个查询
+func dnsTCPExchange(conn net.Conn, query []byte) ([]byte, error) {
+	if err := writeDNSTCP(conn, query); err != nil {
+		return nil, err
+	}
+	resp, err := readDNSTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDNSResponseID(query, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func checkDNSResponseID(query, resp []byte) error {
+	if len(resp) < 12 || len(query) < 2 || resp[0] != query[0] || resp[1] != query[1] {
+		return fmt.Errorf("mismatched DNS response id")
+	}
+	return nil
+}
+
+// directDNSExchanger 直接查询 DNS 服务器,先用 UDP,响应被截断时改用 TCP
+type directDNSExchanger struct {
+	servers []string
+	timeout time.Duration
+}
+
+func (d *directDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var errs []error
+	for _, server := range d.servers {
+		resp, err := (&udpDNSExchanger{server: server, timeout: d.timeout}).exchange(ctx, query)
+		if err == nil {
+			return resp, nil
+		}
+		requestLogger(ctx).Warnf("DNS 服务器 %s 查询失败: %v", server, err)
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// proxyDNSExchanger 通过 proxy 上游 CONNECT 到 DNS 服务器,使用 DNS over TCP 查询
+// 查询完成后隧道保留一段时间,之后的查询在同一个隧道上发送,不需要每次都 CONNECT
+type proxyDNSExchanger struct {
+	servers []string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*dnsTunnel // DNS 服务器 -> 空闲的隧道,最近使用的在最后
+}
+
+// dnsTunnel 一个到 DNS 服务器的空闲隧道
+type dnsTunnel struct {
+	conn      net.Conn
+	idleSince time.Time
+}
+
+func (p *proxyDNSExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	log := requestLogger(ctx)
+	var errs []error
+	for _, server := range p.servers {
+		// 服务器可能已经关闭了空闲的隧道,失败时换一个新的隧道重试
+		if conn := p.getTunnel(server); conn != nil {
+			resp, err := p.query(conn, query)
+			if err == nil {
+				p.putTunnel(server, conn)
+				return resp, nil
+			}
+			conn.Close()
+			log.Debugf("DNS 服务器 %s 的空闲隧道已失效: %v", server, err)
+		}
+		conn, err := p.dial(ctx, server)
+		if err == nil {
+			var resp []byte
+			if resp, err = p.query(conn, query); err == nil {
+				p.putTunnel(server, conn)
+				return resp, nil
+			}
+			conn.Close()
+		}
+		log.Warnf("DNS 服务器 %s 查询失败: %v", server, err)
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dial 通过 proxy 上游建立到 server 的隧道
+func (p *proxyDNSExchanger) dial(ctx context.Context, server string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	reqLine := "CONNECT " + server + " HTTP/1.1\r\n" +
+		"Host: " + server + "\r\n" +
+		"\r\n"
+	conn, attempt, upstream_resp, err := dialTunnel(requestLogger(ctx), buildAttempts(ctx, upstreams.pick(), "proxy", host, port), reqLine)
+	if err != nil {
+		return nil, err
+	}
+	if attempt.method == "proxy" && upstreamStatusCode(upstream_resp) != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("upstream rejected CONNECT: %q", upstream_resp)
+	}
+	return conn, nil
+}
+
+// query 在隧道上发送一个查询,完成后清除超时,隧道可以继续使用
+func (p *proxyDNSExchanger) query(conn net.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	resp, err := dnsTCPExchange(conn, query)
+	if err != nil {
+		return nil, err
+	}
+	return resp, conn.SetDeadline(time.Time{})
+}
+
+// getTunnel 取出 server 最近使用的空闲隧道,没有时返回 nil;空闲太久的隧道直接关闭
+func (p *proxyDNSExchanger) getTunnel(server string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tunnels := p.idle[server]
+	for len(tunnels) > 0 {
+		t := tunnels[len(tunnels)-1]
+		tunnels = tunnels[:len(tunnels)-1]
+		if time.Since(t.idleSince) < dnsTunnelIdleTimeout {
+			p.idle[server] = tunnels
+			return t.conn
+		}
+		t.conn.Close()
+	}
+	delete(p.idle, server)
+	return nil
+}
+
+// putTunnel 保存查询完成的隧道,空闲隧道已满时关闭
+func (p *proxyDNSExchanger) putTunnel(server string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[server]) >= dnsTunnelMaxIdle {
+		conn.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*dnsTunnel)
+	}
+	p.idle[server] = append(p.idle[server], &dnsTunnel{conn: conn, idleSince: time.Now()})
+}
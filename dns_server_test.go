@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startUDPDNSStub 启动按 zone 回答的 UDP DNS 服务器,返回地址和收到的查询数
+func startUDPDNSStub(t *testing.T, zone stubZone) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries atomic.Int32
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		pc.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			pc.WriteTo(zone.answer(t, buf[:n]), addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+// startTCPDNSStub 启动按 zone 回答的 DNS over TCP 服务器,返回地址和收到的查询数
+// closeAfter 大于 0 时每个连接回答这么多个查询后关闭
+func startTCPDNSStub(t *testing.T, zone stubZone, closeAfter int) (string, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	addr := startTCPStub(t, func(conn net.Conn) {
+		for n := 0; closeAfter <= 0 || n < closeAfter; n++ {
+			query, err := readDNSTCP(conn)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			if writeDNSTCP(conn, zone.answer(t, query)) != nil {
+				return
+			}
+		}
+	})
+	return addr, &queries
+}
+
+// countingConnectProxy 和 stubConnectProxy 相同,同时记录收到的 CONNECT 数
+func countingConnectProxy(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var connects atomic.Int32
+	handle := stubConnectProxy("200")
+	addr := startTCPStub(t, func(conn net.Conn) {
+		connects.Add(1)
+		handle(conn)
+	})
+	return addr, &connects
+}
+
+// startTestDNSServer 在本地随机端口启动 DNS 服务,返回 UDP 和 TCP 地址
+func startTestDNSServer(t *testing.T, cfg DNSServer) (string, string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	s := newDNSServer(cfg)
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+		// 关闭保留的空闲隧道,桩代理的连接处理才能结束
+		p := s.exchangers["proxy"].(*proxyDNSExchanger)
+		for server := range p.idle {
+			for conn := p.getTunnel(server); conn != nil; conn = p.getTunnel(server) {
+				conn.Close()
+			}
+		}
+	})
+	go s.serveUDP(pc)
+	go s.serveTCP(l)
+	return pc.LocalAddr().String(), l.Addr().String()
+}
+
+func newDNSQuery(t testing.TB, name string, typ dnsmessage.Type, id uint16) []byte {
+	t.Helper()
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name + "."), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// dnsAnswer 解析响应,返回 rcode、TC 标志和所有 A/AAAA 地址
+func dnsAnswer(t testing.TB, resp []byte) (dnsmessage.RCode, bool, []string) {
+	t.Helper()
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, rr := range m.Answers {
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(b.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(b.AAAA[:]).String())
+		}
+	}
+	return m.Header.RCode, m.Header.Truncated, addrs
+}
+
+func testDNSConfig(direct, proxy string) DNSServer {
+	return DNSServer{Direct: []string{direct}, Proxy: []string{proxy}, Timeout: 2 * time.Second, CacheSize: 64, NegativeTTL: time.Minute}
+}
+
+func TestDNSServerRoutes(t *testing.T) {
+	directAddr, directQueries := startUDPDNSStub(t, stubZone{ttl: 60, addrs: map[string][]string{
+		"direct.test": {"192.0.2.1", "2001:db8::1"},
+	}})
+	proxyDNS, proxyQueries := startTCPDNSStub(t, stubZone{ttl: 60, addrs: map[string][]string{
+		"proxied.test": {"198.51.100.1"},
+	}}, 0)
+	proxy, _ := countingConnectProxy(t)
+	withUpstreams(t, Config{Rules: []Rule{
+		{DomainPattern: "direct.test", ForwardMethod: "direct"},
+		{DomainPattern: "proxied.test", ForwardMethod: "proxy"},
+		{DomainPattern: "blocked.test", ForwardMethod: "block"},
+	}}, proxy)
+	udpAddr, tcpAddr := startTestDNSServer(t, testDNSConfig(directAddr, proxyDNS))
+	udp := &udpDNSExchanger{server: udpAddr, timeout: 2 * time.Second}
+	tcp := &tcpDNSExchanger{server: tcpAddr, timeout: 2 * time.Second}
+
+	tests := []struct {
+		name      string
+		ex        dnsExchanger
+		host      string
+		typ       dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		wantAddrs []string
+	}{
+		{"direct A", udp, "direct.test", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.1"}},
+		{"direct AAAA", udp, "direct.test", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"2001:db8::1"}},
+		{"direct over tcp", tcp, "direct.test", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.1"}},
+		{"proxy", udp, "proxied.test", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"198.51.100.1"}},
+		{"proxy nxdomain", udp, "missing.proxied.test", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"block", udp, "blocked.test", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := newDNSQuery(t, tt.host, tt.typ, uint16(100+i))
+			resp, err := tt.ex.exchange(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rcode, _, addrs := dnsAnswer(t, resp)
+			if rcode != tt.wantRCode || fmt.Sprint(addrs) != fmt.Sprint(tt.wantAddrs) {
+				t.Fatalf("answer = %v %v, want %v %v", rcode, addrs, tt.wantRCode, tt.wantAddrs)
+			}
+		})
+	}
+	// 第二次 direct.test A 查询(over tcp)命中缓存
+	if got := directQueries.Load(); got != 2 {
+		t.Errorf("direct server queries = %d, want 2", got)
+	}
+	// missing.proxied.test 不匹配 proxied.test 规则,按默认路由走 proxy
+	if got := proxyQueries.Load(); got != 2 {
+		t.Errorf("proxy server queries = %d, want 2", got)
+	}
+}
+
+// 通过 proxy 查询时多个查询共用一个隧道,服务器关闭隧道后重新建立
+func TestDNSServerReusesProxyTunnel(t *testing.T) {
+	zone := stubZone{ttl: 60, addrs: map[string][]string{}}
+	for i := range 5 {
+		zone.addrs[fmt.Sprintf("h%d.proxied.test", i)] = []string{fmt.Sprintf("198.51.100.%d", i+1)}
+	}
+	tests := []struct {
+		name         string
+		closeAfter   int
+		wantConnects int32
+	}{
+		{"kept open", 0, 1},
+		// 服务器每个连接只回答两个查询,第三个查询在失效的隧道上失败后重新建立
+		{"closed by server", 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyDNS, _ := startTCPDNSStub(t, zone, tt.closeAfter)
+			proxy, connects := countingConnectProxy(t)
+			withUpstreams(t, Config{Rules: []Rule{{DomainPattern: "*.proxied.test", ForwardMethod: "proxy"}}}, proxy)
+			udpAddr, _ := startTestDNSServer(t, testDNSConfig("127.0.0.1:1", proxyDNS))
+			udp := &udpDNSExchanger{server: udpAddr, timeout: 2 * time.Second}
+
+			for i := range 5 {
+				resp, err := udp.exchange(context.Background(), newDNSQuery(t, fmt.Sprintf("h%d.proxied.test", i), dnsmessage.TypeA, uint16(i+1)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rcode, _, addrs := dnsAnswer(t, resp); rcode != dnsmessage.RCodeSuccess || len(addrs) != 1 {
+					t.Fatalf("query %d: answer = %v %v", i, rcode, addrs)
+				}
+			}
+			if got := connects.Load(); got != tt.wantConnects {
+				t.Fatalf("CONNECT requests = %d, want %d", got, tt.wantConnects)
+			}
+		})
+	}
+}
+
+// 超过 512 字节的响应通过 UDP 发送时设置 TC 标志,通过 TCP 发送完整响应
+func TestDNSServerTruncatesUDP(t *testing.T) {
+	var addrs []string
+	for i := range 40 {
+		addrs = append(addrs, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	directAddr, _ := startUDPDNSStub(t, stubZone{ttl: 60, addrs: map[string][]string{"big.test": addrs}})
+	withUpstreams(t, Config{Rules: []Rule{{DomainPattern: "big.test", ForwardMethod: "direct"}}})
+	udpAddr, tcpAddr := startTestDNSServer(t, testDNSConfig(directAddr, "127.0.0.1:1"))
+
+	query := newDNSQuery(t, "big.test", dnsmessage.TypeA, 7)
+	resp, err := (&udpDNSExchanger{server: udpAddr, timeout: 2 * time.Second}).exchangeUDP(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, tc, got := dnsAnswer(t, resp); !tc || len(got) != 0 {
+		t.Fatalf("udp answer: truncated = %v, %d records, want truncated and empty", tc, len(got))
+	}
+	resp, err = (&tcpDNSExchanger{server: tcpAddr, timeout: 2 * time.Second}).exchange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, tc, got := dnsAnswer(t, resp); tc || len(got) != len(addrs) {
+		t.Fatalf("tcp answer: truncated = %v, %d records, want %d", tc, len(got), len(addrs))
+	}
+}
+
+// 大量并发的 UDP 查询都能得到回答
+func TestDNSServerConcurrentUDP(t *testing.T) {
+	const n = 100
+	zone := stubZone{ttl: 60, addrs: map[string][]string{}}
+	for i := range n {
+		zone.addrs[fmt.Sprintf("h%d.direct.test", i)] = []string{fmt.Sprintf("192.0.2.%d", i+1)}
+	}
+	directAddr, _ := startUDPDNSStub(t, zone)
+	withUpstreams(t, Config{Rules: []Rule{{DomainPattern: "*.direct.test", ForwardMethod: "direct"}}})
+	udpAddr, _ := startTestDNSServer(t, testDNSConfig(directAddr, "127.0.0.1:1"))
+	udp := &udpDNSExchanger{server: udpAddr, timeout: 5 * time.Second}
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := udp.exchange(context.Background(), newDNSQuery(t, fmt.Sprintf("h%d.direct.test", i), dnsmessage.TypeA, uint16(i+1)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, _, addrs := dnsAnswer(t, resp); len(addrs) != 1 || addrs[0] != fmt.Sprintf("192.0.2.%d", i+1) {
+				t.Errorf("query %d: answer = %v", i, addrs)
+			}
+		}()
+	}
+	wg.Wait()
+}
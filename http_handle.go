@@ -2,179 +2,416 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func createHTTPRequest(reqline string, body []byte) (*http.Request, error) {
-	reader := strings.NewReader(reqline)
-	req, err := http.ReadRequest(bufio.NewReader(reader))
+// createHTTPRequest 解析请求头,请求体从 reader 中流式读取,不会整体读入内存
+func createHTTPRequest(reqline string, reader *bufio.Reader) (*http.Request, error) {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(reqline)))
 	if err != nil {
 		return nil, fmt.Errorf("error parsing HTTP request: %v", err)
 	}
 
-	if len(body) > 0 {
-		req.Body = io.NopCloser(bytes.NewReader(body))
-		req.ContentLength = int64(len(body))
+	switch {
+	case len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked":
+		req.Body = &chunkedBody{r: reader, cr: httputil.NewChunkedReader(reader), trailer: req.Trailer}
+	case req.ContentLength > 0:
+		req.Body = io.NopCloser(io.LimitReader(reader, req.ContentLength))
+	default:
+		req.Body = http.NoBody
 	}
 
 	return req, nil
 }
 
-func handleConnectRequest_http(conn net.Conn, req *http.Request) {
-	proxy_upstream := *proxyAddr
+// chunkedBody 解码客户端 chunked 编码的请求体,读到结尾时把 trailer 填入 trailer
+type chunkedBody struct {
+	r       *bufio.Reader
+	cr      io.Reader
+	trailer http.Header
+	done    bool
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.cr.Read(p)
+	if err == io.EOF {
+		b.done = true
+		if err := b.readTrailer(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// readTrailer 读取最后一个 chunk 之后的 trailer,直到空行
+// 只保留请求头 Trailer 中声明过的字段
+func (b *chunkedBody) readTrailer() error {
+	h, err := textproto.NewReader(b.r).ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("error reading request trailer: %v", err)
+	}
+	for k, v := range h {
+		if _, ok := b.trailer[k]; ok {
+			b.trailer[k] = v
+		}
+	}
+	return nil
+}
+
+func (b *chunkedBody) Close() error {
+	return nil
+}
+
+// handleConnectRequest_http 处理一个普通 HTTP 请求
+// 返回 true 表示响应已经完整发送,客户端连接可以继续读取下一个请求
+func handleConnectRequest_http(conn net.Conn, req *http.Request) bool {
+	proxy_upstream := upstreams.pick()
 	var host string
 	if strings.Contains(req.Host, ":") {
 		host = strings.Split(req.Host, ":")[0]
 	} else {
 		host = req.Host
 	}
-	log := logrus.WithField("reqID", req.Context().Value(requestIDKey))
-	upstream, ForwardMethod := getForwardMethodForHost(log, proxy_upstream, host, req.URL.Port(), "http")
-
-	switch ForwardMethod {
-	case "proxy":
-		handleConnection_http_proxy(conn, req, upstream)
-	case "direct":
-		handleConnection_http(conn, req)
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	log := requestLogger(req.Context())
+	upstream, ForwardMethod := getForwardMethodForHost(req.Context(), proxy_upstream, host, port, "http")
 
-	case "block":
-		conn.Close()
+	if ForwardMethod == "block" {
 		//让客户端连接直接关闭
-		return
+		return false
 	}
-}
 
-// 修改 handleConnection_http 函数
-func handleConnection_http(clientConn net.Conn, req *http.Request) {
-	defer clientConn.Close()
-	log := logrus.WithField("reqID", req.Context().Value(requestIDKey))
+	attempts := buildAttempts(req.Context(), upstream, ForwardMethod, host, port)
+	for first := true; ; first = false {
+		targetConn, attempt, err := getUpstreamConn(log, attempts, first)
+		if err != nil {
+			log.Errorf("Failed to connect to target: %v", err)
+			return false
+		}
 
-	var addr string
-	if !strings.Contains(req.URL.Host, ":") {
-		addr = req.URL.Host + ":" + "80"
-	} else {
-		addr = req.URL.Host
+		var res roundTripResult
+		switch attempt.method {
+		case "proxy":
+			res, err = handleConnection_http_proxy(conn, req, attempt, targetConn)
+		case "direct":
+			res, err = handleConnection_http(conn, req, attempt, targetConn)
+		default:
+			log.Errorf("未知的转发方式 %q", attempt.method)
+			targetConn.Close()
+			return false
+		}
+		// 复用的连接可能在发送请求的同时被对端关闭,没有请求体时可以安全地换一个新连接重发
+		if err != nil && targetConn.reused && !res.responded && req.Body == http.NoBody {
+			log.Debugf("复用的上游连接已失效,重新建立连接: %v", err)
+			continue
+		}
+		return res.clientKeepAlive
 	}
-	if req.URL.Host != "" {
-		if strings.Contains(req.RequestURI, req.URL.Host) {
-			newRUI := strings.Split(req.RequestURI, req.URL.Host)[1]
-			req.RequestURI = newRUI
+}
+
+// getUpstreamConn 取得发送请求用的上游连接
+// usePool 为 true 时先从连接池中查找首选路线的空闲连接,
+// 没有时依次尝试 attempts 建立新连接,还没有向上游发送任何数据,连接失败时可以换下一个上游重试
+func getUpstreamConn(log *logrus.Entry, attempts []upstreamAttempt, usePool bool) (*pooledConn, upstreamAttempt, error) {
+	if usePool {
+		first := attempts[0]
+		if c := httpConnPool.get(poolKey(first)); c != nil {
+			// 连接池中的连接同样要经过熔断器,熔断时放回连接池,由 dialAttempts 跳过这个上游
+			if first.method != "proxy" || upstreams.acquire(first.addr) {
+				log.Debugf("复用连接池中的连接: method: %s upstream: %s", first.method, first.addr)
+				return c, first, nil
+			}
+			httpConnPool.put(c)
 		}
 	}
-	targetConn, err := net.Dial("tcp", addr)
+	conn, attempt, err := dialAttempts(log, attempts, nil)
 	if err != nil {
-		log.Errorf("Failed to connect to target: %v", err)
+		return nil, attempt, err
+	}
+	return newPooledConn(conn, poolKey(attempt)), attempt, nil
+}
+
+// releaseUpstreamConn 请求结束后把可以复用的上游连接放回连接池,否则关闭
+func releaseUpstreamConn(c *pooledConn, res roundTripResult) {
+	if res.upstreamReuse {
+		httpConnPool.put(c)
 		return
 	}
-	defer targetConn.Close()
+	c.Close()
+}
+
+// 修改 handleConnection_http 函数
+func handleConnection_http(clientConn net.Conn, req *http.Request, attempt upstreamAttempt, targetConn *pooledConn) (roundTripResult, error) {
+	log := requestLogger(req.Context())
 
-	// 将客户端的请求转发到目标服务器
-	reqBytes, err := httputil.DumpRequest(req, true)
+	shaped := shapeConn(clientConn, attempt)
+	defer releaseShapedConn(shaped)
+	req.Body = shapeRequestBody(shaped, req.Body)
+	res, err := roundTrip(log, shaped, req, targetConn, false)
 	if err != nil {
-		log.Errorf("Failed to dump request: %v", err)
-		return
+		log.Errorf("Failed to read response: %v", err)
+	}
+	if res.upgraded {
+		// 101 之后连接变成双向的原始数据通道
+		forward_io_copy(req.Context(), clientConn, targetConn, attempt)
+		return res, nil
 	}
-	_, err = targetConn.Write(reqBytes)
+	releaseUpstreamConn(targetConn, res)
+	return res, err
+}
+
+// 修改 handleConnection_http_proxy 函数
+func handleConnection_http_proxy(clientConn net.Conn, req *http.Request, attempt upstreamAttempt, upstreamConn *pooledConn) (roundTripResult, error) {
+	log := requestLogger(req.Context())
+	upstream := attempt.addr
+
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+
+	shaped := shapeConn(clientConn, attempt)
+	defer releaseShapedConn(shaped)
+	req.Body = shapeRequestBody(shaped, req.Body)
+	res, err := roundTrip(log, shaped, req, upstreamConn, true)
 	if err != nil {
-		log.Errorf("Failed to forward request: %v", err)
-		return
+		log.Errorf("Failed to read response from upstream: %v", err)
+	}
+	// 每个请求在得到结果后报告一次;复用的连接失效不代表上游异常,只归还探测名额,由调用方重试
+	if err == nil || !upstreamConn.reused {
+		upstreams.report(log, upstream, err)
+	} else {
+		upstreams.release(upstream)
 	}
+	if res.upgraded {
+		// 101 之后连接变成双向的原始数据通道
+		forward_io_copy(req.Context(), clientConn, upstreamConn, attempt)
+		return res, nil
+	}
+	releaseUpstreamConn(upstreamConn, res)
+	return res, err
+}
+
+// roundTripResult 一次请求转发的结果
+type roundTripResult struct {
+	clientKeepAlive bool // 客户端连接可以继续读取下一个请求
+	upstreamReuse   bool // 上游连接可以放回连接池
+	responded       bool // 已经向客户端发送过数据
+	upgraded        bool // 上游返回了 101 Switching Protocols,连接需要转为隧道
+}
+
+// roundTrip 把 req 发送到 targetConn,并把响应转发给客户端
+// 请求体和响应体都是流式转发的,内存占用与消息大小无关。
+// 请求在单独的 goroutine 中发送,这样 Expect: 100-continue 时上游的 1xx 响应可以先转发给客户端,
+// 客户端收到后才会发送请求体。
+// viaProxy 为 true 时请求行使用绝对 URI(发给上游代理),否则使用 origin-form(直接发给目标服务器)。
+// 返回的 err 只表示没有从上游读到响应
+func roundTrip(log *logrus.Entry, clientConn net.Conn, req *http.Request, targetConn *pooledConn, viaProxy bool) (roundTripResult, error) {
+	var res roundTripResult
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// 客户端没有 User-Agent 时不要让 net/http 加上默认值
+		req.Header["User-Agent"] = []string{""}
+	}
+	// 客户端和上游的连接是分开管理的,客户端的连接管理头不转发给上游
+	upgrade := isUpgradeRequest(req)
+	clientClose := req.Close
+	policy := domainForwardMap.headerPolicy(matchRule(req.Context(), requestHostname(req)))
+	// 复用的连接失效时调用方会用同一个 req 重试,头部处理在副本上进行,
+	// 否则重试时 Via、Forwarded 和 X-Forwarded-For 会重复添加
+	out := new(http.Request)
+	*out = *req
+	out.Header = req.Header.Clone()
+	out.Close = false
+	applyRequestHeaderPolicy(out, clientConn.RemoteAddr(), policy, upgrade)
+	req = out
+
+	writeDone := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriter(targetConn)
+		var err error
+		if viaProxy {
+			err = req.WriteProxy(bw)
+		} else {
+			err = req.Write(bw)
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		writeDone <- err
+	}()
 
 	// 读取目标服务器的响应
 	// HTTP 响应，在 Expect: 100-continue 机制下，可以返回多条。
-	reader := bufio.NewReader(targetConn)
+	cw := bufio.NewWriter(clientConn)
 	for {
-		resp, err := http.ReadResponse(reader, req)
+		resp, err := http.ReadResponse(targetConn.br, req)
 		if err != nil {
-			log.Errorf("Failed to read response: %v", err)
-			return
+			// 调用方可能用同一个 req 重试,返回前要确保发送请求的 goroutine 已经退出
+			finishWrite(clientConn, targetConn, writeDone, 0)
+			return res, err
 		}
 
-		// dump and forward
-		respBytes, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			log.Errorf("Failed to dump response: %v", err)
-			return
+		applyResponseHeaderPolicy(resp, policy)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if !upgrade {
+				finishWrite(clientConn, targetConn, writeDone, 0)
+				return res, fmt.Errorf("unexpected 101 response to a request without Upgrade")
+			}
+			return switchProtocols(log, cw, resp, writeDone)
 		}
 
-		_, err = clientConn.Write(respBytes)
+		// 收到最终响应（非 1xx）
+		final := resp.StatusCode < 100 || resp.StatusCode >= 200
+		if final {
+			res.upstreamReuse = !resp.Close && bodyDelimited(req, resp)
+			res.clientKeepAlive = setClientKeepAlive(req, resp, clientClose)
+		}
+
+		res.responded = true
+		err = resp.Write(cw)
+		if err == nil {
+			err = cw.Flush()
+		}
+		resp.Body.Close()
 		if err != nil {
 			log.Errorf("Failed to send response: %v", err)
-			return
+			res.clientKeepAlive, res.upstreamReuse = false, false
+			finishWrite(clientConn, targetConn, writeDone, 0)
+			return res, nil
 		}
 
-		// 收到最终响应（非 1xx），跳出循环
-		if resp.StatusCode < 100 || resp.StatusCode >= 200 {
+		if final {
 			break
 		}
-
 		// 如果是 1xx，例如 100 Continue，则继续读下一条
 	}
 
+	// 请求体没有完整发送时,客户端连接上还有没读完的数据,不能继续复用
+	if err, finished := finishWrite(clientConn, targetConn, writeDone, requestBodyWait); !finished {
+		log.Debug("请求体还没有发送完,关闭客户端连接")
+		res.clientKeepAlive, res.upstreamReuse = false, false
+	} else if err != nil {
+		log.Debugf("Failed to forward request: %v", err)
+		res.clientKeepAlive, res.upstreamReuse = false, false
+	}
+	return res, nil
 }
 
-// 修改 handleConnection_http_proxy 函数
-func handleConnection_http_proxy(clientConn net.Conn, req *http.Request, upstream string) {
-	defer clientConn.Close()
-	log := logrus.WithField("reqID", req.Context().Value(requestIDKey))
-
-	upstreamConn, err := net.Dial("tcp", upstream)
-	if err != nil {
-		log.Errorf("Failed to connect to upstream proxy: %v", err)
-		return
+// requestBodyWait 收到最终响应后等待请求体发送完成的时间
+const requestBodyWait = time.Second
+
+// finishWrite 等待发送请求的 goroutine 结束,最多等待 wait。
+// 超时后关闭上游连接并中断客户端请求体的读取,再等待 goroutine 退出,
+// 保证返回之后不会再有 goroutine 访问 req 和两个连接。finished 为 false 表示请求没有发送完
+func finishWrite(clientConn, targetConn net.Conn, writeDone <-chan error, wait time.Duration) (err error, finished bool) {
+	select {
+	case err := <-writeDone:
+		return err, true
+	default:
 	}
-	defer upstreamConn.Close()
-
-	req.URL.Scheme = "http"
-	req.URL.Host = req.Host
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case err := <-writeDone:
+			return err, true
+		case <-timer.C:
+		}
+	}
+	targetConn.Close()
+	clientConn.SetReadDeadline(time.Now())
+	// 限速的请求体可能正在等待令牌
+	releaseShapedConn(clientConn)
+	<-writeDone
+	clientConn.SetReadDeadline(time.Time{})
+	return nil, false
+}
 
-	// 将请求转发到上游代理
-	reqBytes, err := httputil.DumpRequest(req, true)
-	if err != nil {
-		log.Errorf("Failed to dump request: %v", err)
-		return
+// switchProtocols 把 101 响应转发给客户端,之后由调用方把两个连接转为隧道
+func switchProtocols(log *logrus.Entry, cw *bufio.Writer, resp *http.Response, writeDone <-chan error) (roundTripResult, error) {
+	res := roundTripResult{responded: true}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	err := resp.Write(cw)
+	if err == nil {
+		err = cw.Flush()
 	}
-	_, err = upstreamConn.Write(reqBytes)
 	if err != nil {
-		log.Errorf("Failed to forward request to upstream: %v", err)
-		return
+		log.Errorf("Failed to send response: %v", err)
+		<-writeDone
+		return res, nil
 	}
-
-	// 读取上游代理的响应
-	resp, err := http.ReadResponse(bufio.NewReader(upstreamConn), req)
-	if err != nil {
-		log.Errorf("Failed to read response from upstream: %v", err)
-		return
+	// Upgrade 请求没有请求体,请求应该已经发送完成
+	if err := <-writeDone; err != nil {
+		log.Errorf("Failed to forward request: %v", err)
+		return res, nil
 	}
-	defer resp.Body.Close()
+	log.Debugf("协议切换为 %s", resp.Header.Get("Upgrade"))
+	res.upgraded = true
+	return res, nil
+}
 
-	// 将响应写入到缓冲区以计算大小
-	respBytes, err := httputil.DumpResponse(resp, true)
-	if err != nil {
-		log.Errorf("Failed to dump response: %v", err)
-		return
-	}
-	_, err = clientConn.Write(respBytes)
-	if err != nil {
-		log.Errorf("Failed to send response to client: %v", err)
-		return
+// isUpgradeRequest 请求是否要求切换协议(Connection: Upgrade 且带有 Upgrade 头)
+func isUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && headerContainsToken(req.Header, "Connection", "upgrade")
+}
+
+// headerContainsToken 判断逗号分隔的头部字段中是否包含 token,忽略大小写
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
+// bodyDelimited 响应体是否有明确的结束位置,而不是靠关闭连接来标记结束
+func bodyDelimited(req *http.Request, resp *http.Response) bool {
+	return resp.ContentLength >= 0 ||
+		req.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked")
 }
 
-// 读取 HTTP 请求头直到遇到空行
-func readRequestHeader(conn net.Conn) (string, error) {
-	// 创建一个新的缓冲读取器
-	reader := bufio.NewReader(conn)
+// setClientKeepAlive 判断发送 resp 之后客户端连接能否继续使用,并据此设置响应的 Connection 头
+// 客户端要求关闭(Connection: close,或者 HTTP/1.0 没有 keep-alive)时关闭;
+// 响应体只能靠关闭连接来标记结束时也必须关闭,HTTP/1.0 客户端不支持 chunked
+func setClientKeepAlive(req *http.Request, resp *http.Response, clientClose bool) bool {
+	chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+	keepAlive := !clientClose && bodyDelimited(req, resp) && (!chunked || req.ProtoAtLeast(1, 1))
+
+	// 代理转发响应时使用自己的协议版本,否则 HTTP/1.0 的上游响应会让客户端关闭连接
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	// 上游的 Connection 头对客户端没有意义
+	resp.Header.Del("Connection")
+	resp.Header.Del("Keep-Alive")
+	resp.Close = !keepAlive
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		// HTTP/1.0 客户端需要显式的 keep-alive
+		resp.Header.Set("Connection", "keep-alive")
+		resp.Header.Set("Keep-Alive", fmt.Sprintf("timeout=%d", int(domainForwardMap.clientKeepAlive().IdleTimeout.Seconds())))
+	}
+	return keepAlive
+}
 
+// 读取 HTTP 请求头直到遇到空行
+// reader 需要是连接自己的读缓冲(bufferedConn.br),头部之后多读的数据会留在其中
+func readRequestHeader(reader *bufio.Reader) (string, error) {
 	// 用于构建请求数据
 	var requestBuilder strings.Builder
 
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trackingListener 记录接受的连接,用于测试结束时关闭连接并等待处理结束
+type trackingListener struct {
+	net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.conns = append(l.conns, conn)
+	l.mu.Unlock()
+	l.wg.Add(1)
+	return conn, nil
+}
+
+func (l *trackingListener) shutdown() {
+	l.Listener.Close()
+	l.mu.Lock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
+// startTestProxy 在本地随机端口启动混合代理,使用当前的 domainForwardMap,
+// 测试结束时关闭监听和所有连接,等待处理结束后再恢复全局变量
+func startTestProxy(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, ln, "", handleMixedConn)
+	return ln.Addr().String()
+}
+
+// serveTestListener 用 serve 处理 ln 上的连接,测试结束时的清理和 startTestProxy 相同
+func serveTestListener(t *testing.T, ln net.Listener, tag string, handle func(ctx context.Context, conn net.Conn)) {
+	t.Helper()
+	oldPool := httpConnPool
+	pool := newConnPool(domainForwardMap.upstreamPool())
+	t.Cleanup(func() {
+		// 关闭空闲的上游连接,桩服务器的处理函数才能结束
+		pool.mu.Lock()
+		var idle []*pooledConn
+		for _, conns := range pool.idle {
+			idle = append(idle, conns...)
+		}
+		pool.mu.Unlock()
+		for _, c := range idle {
+			pool.discard(c)
+		}
+		httpConnPool = oldPool
+	})
+	httpConnPool = pool
+	tl := &trackingListener{Listener: ln}
+	t.Cleanup(tl.shutdown)
+	go serve(tl, tag, func(ctx context.Context, conn net.Conn) {
+		defer tl.wg.Done()
+		handle(ctx, conn)
+	})
+}
+
+// patternReader 不断产生固定内容的数据,不占用额外内存
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i)
+	}
+	return len(p), nil
+}
+
+// 请求体和响应体都是数 GB 时,代理应当流式转发,内存占用保持在较小的范围内
+func TestProxyStreamsLargeBody(t *testing.T) {
+	if testing.Short() {
+		t.Skip("传输数 GB 数据,-short 时跳过")
+	}
+	// 数据量远大于允许的堆内存,缓冲整个请求体或响应体都会超出限制
+	var size int64 = 2 << 30
+	if raceEnabled {
+		size = 256 << 20
+	}
+	const maxHeap = 64 << 20
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Received", strconv.FormatInt(n, 10))
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		io.CopyN(w, patternReader{}, size)
+	}))
+	defer target.Close()
+
+	withUpstreams(t, Config{})
+	proxyURL := &url.URL{Scheme: "http", Host: startTestProxy(t)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// 传输过程中定期采样堆内存
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak.Load() {
+				peak.Store(ms.HeapInuse)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, target.URL+"/upload", io.LimitReader(patternReader{}, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s", resp.Status)
+	}
+	if got := resp.Header.Get("X-Received"); got != strconv.FormatInt(size, 10) {
+		t.Fatalf("target received %s bytes, want %d", got, size)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Fatalf("response body = %d bytes, want %d", n, size)
+	}
+
+	close(stop)
+	<-sampled
+	if p := peak.Load(); p > maxHeap {
+		t.Fatalf("peak heap in use = %d MiB, want <= %d MiB", p>>20, maxHeap>>20)
+	}
+	t.Logf("peak heap in use: %d MiB", peak.Load()>>20)
+}
+
+// 上游不读取请求体就返回响应时,代理转发响应后关闭客户端连接,不会一直等待请求体
+func TestRoundTripStopsPendingRequestBody(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\n\r\n")
+		io.Copy(io.Discard, conn)
+	})
+	withUpstreams(t, Config{})
+	proxy := startTestProxy(t)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 声明 1 MiB 的请求体,只发送一部分
+	io.WriteString(conn, "POST http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\nContent-Length: 1048576\r\n\r\npartial")
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %s, want 413", resp.Status)
+	}
+	start := time.Now()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after response: err = %v, want EOF", err)
+	}
+	if d := time.Since(start); d > requestBodyWait+time.Second {
+		t.Fatalf("client connection closed after %v", d)
+	}
+}
+
+// 复用的上游连接失效后重试时,请求头只处理一次,客户端的 Connection: close 仍然生效
+func TestRetryAppliesHeaderPolicyOnce(t *testing.T) {
+	var conns atomic.Int32
+	target := startTCPStub(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if conns.Add(1) == 1 {
+			// 第一个连接回复一次后,在收到下一个请求时直接关闭
+			if _, err := http.ReadRequest(br); err != nil {
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+			http.ReadRequest(br)
+			return
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body := fmt.Sprintf("via=%d xff=%q forwarded=%d", len(req.Header.Values("Via")),
+			req.Header.Get("X-Forwarded-For"), len(req.Header.Values("Forwarded")))
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	})
+	withUpstreams(t, Config{Headers: HeaderPolicy{Via: &enabled, XForwardedFor: &enabled, Forwarded: &enabled}})
+	proxy := startTestProxy(t)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET http://"+target+"/first HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	io.WriteString(conn, "GET http://"+target+"/second HTTP/1.1\r\nHost: "+target+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Fatalf("target connections = %d, want 2 (request retried once)", n)
+	}
+	if want := `via=1 xff="127.0.0.1" forwarded=1`; string(body) != want {
+		t.Fatalf("headers seen by target: %s, want %s", body, want)
+	}
+	if !resp.Close {
+		t.Fatal("response to Connection: close request did not close the client connection")
+	}
+}
+
+// 一个客户端连接上 pipelining 的多个请求按顺序处理,Connection: close 和 HTTP/1.0 结束连接
+func TestPipelinedRequests(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s%s", r.Method, r.URL.Path, body)
+	}))
+	defer target.Close()
+	host := target.Listener.Addr().String()
+	withUpstreams(t, Config{})
+	proxy := startTestProxy(t)
+
+	t.Run("keep-alive", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		// 三个请求一次发送,代理读取第一个请求时会把后面的请求一起读进缓冲
+		io.WriteString(conn, "GET http://"+host+"/1 HTTP/1.1\r\nHost: "+host+"\r\n\r\n"+
+			"POST http://"+host+"/2 HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 5\r\n\r\n:body"+
+			"GET http://"+host+"/3 HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		for _, want := range []string{"GET /1", "POST /2:body", "GET /3"} {
+			if got := readBody(t, br); got != want {
+				t.Fatalf("response = %q, want %q", got, want)
+			}
+		}
+
+		io.WriteString(conn, "GET http://"+host+"/4 HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+		if got := readBody(t, br); got != "GET /4" {
+			t.Fatalf("response = %q, want %q", got, "GET /4")
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Fatalf("read after Connection: close: err = %v, want EOF", err)
+		}
+	})
+
+	t.Run("HTTP/1.0", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		io.WriteString(conn, "GET http://"+host+"/a HTTP/1.0\r\nHost: "+host+"\r\n\r\n"+
+			"GET http://"+host+"/b HTTP/1.0\r\nHost: "+host+"\r\n\r\n")
+		br := bufio.NewReader(conn)
+		if got := readBody(t, br); got != "GET /a" {
+			t.Fatalf("response = %q, want %q", got, "GET /a")
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Fatalf("read after HTTP/1.0 response: err = %v, want EOF", err)
+		}
+	})
+}
+
+// readBody 读取一个 200 响应,返回响应体
+func readBody(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, body %q", resp.Status, body)
+	}
+	return string(body)
+}
+
+// upgradeEchoStub 回复 101 后先发送 hello,之后把收到的数据加上 echo: 前缀发回
+func upgradeEchoStub(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || !isUpgradeRequest(req) {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: "+req.Header.Get("Upgrade")+"\r\nConnection: Upgrade\r\n\r\nhello")
+	buf := make([]byte, 1024)
+	for {
+		n, err := br.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append([]byte("echo:"), buf[:n]...)); err != nil {
+			return
+		}
+	}
+}
+
+// forwardProxyStub 普通 HTTP 的上游代理: 把请求转发给目标后双向转发原始数据
+func forwardProxyStub(requests *atomic.Int32) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests.Add(1)
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		if err := req.Write(target); err != nil {
+			return
+		}
+		go func() {
+			io.Copy(target, br)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+	}
+}
+
+// Upgrade 请求收到 101 后,代理把客户端和目标之间的连接转为双向隧道
+func TestUpgradeTunnel(t *testing.T) {
+	target := startTCPStub(t, upgradeEchoStub)
+	var upstreamRequests atomic.Int32
+	upstream := startTCPStub(t, forwardProxyStub(&upstreamRequests))
+
+	for _, tc := range []struct {
+		name   string
+		method string
+	}{
+		{"direct", "direct"},
+		{"proxy upstream", "proxy"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstreamRequests.Store(0)
+			host, _, _ := net.SplitHostPort(target)
+			withUpstreams(t, Config{Rules: []Rule{{DomainPattern: host, ForwardMethod: tc.method}}}, upstream)
+			proxy := startTestProxy(t)
+
+			conn := dialTestProxy(t, proxy)
+			io.WriteString(conn, "GET http://"+target+"/chat HTTP/1.1\r\nHost: "+target+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+				t.Fatalf("response = %s Upgrade: %q, want 101 echo", resp.Status, resp.Header.Get("Upgrade"))
+			}
+			// 目标在 101 之后立即发送的数据
+			if got := readN(t, br, len("hello")); got != "hello" {
+				t.Fatalf("server data = %q, want hello", got)
+			}
+			for _, msg := range []string{"ping", "second message"} {
+				io.WriteString(conn, msg)
+				if got := readN(t, br, len("echo:")+len(msg)); got != "echo:"+msg {
+					t.Fatalf("echo = %q, want %q", got, "echo:"+msg)
+				}
+			}
+
+			want := int32(0)
+			if tc.method == "proxy" {
+				want = 1
+			}
+			if n := upstreamRequests.Load(); n != want {
+				t.Fatalf("upstream proxy saw %d requests, want %d", n, want)
+			}
+		})
+	}
+}
+
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
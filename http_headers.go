@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders RFC 7230 6.1 中只对单跳连接有意义、代理不能转发的头部
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // 非标准,但很多客户端会发送
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer", // 由 net/http 根据 Trailer 字段重新生成
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders 删除 hop-by-hop 头部以及 Connection 中列出的头部
+// 只删除连接管理相关的头部(strict 为 false)时其余头部原样转发
+func removeHopByHopHeaders(h http.Header, strict bool) {
+	if strict {
+		for _, v := range h.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					h.Del(name)
+				}
+			}
+		}
+		for _, name := range hopByHopHeaders {
+			h.Del(name)
+		}
+		return
+	}
+	// 客户端和上游的连接是分开管理的,连接管理头无论如何都不能转发
+	h.Del("Connection")
+	h.Del("Proxy-Connection")
+	h.Del("Keep-Alive")
+}
+
+// applyRequestHeaderPolicy 按规则处理转发给上游的请求头
+func applyRequestHeaderPolicy(req *http.Request, clientAddr net.Addr, policy HeaderPolicy, upgrade bool) {
+	upgradeProto := req.Header.Get("Upgrade")
+	removeHopByHopHeaders(req.Header, *policy.StripHopByHop)
+	if upgrade {
+		// Upgrade 请求(例如 WebSocket)需要保留 Connection: Upgrade
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgradeProto)
+	}
+
+	if *policy.Via {
+		req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, policy.ViaName))
+	}
+
+	clientIP := ""
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP.String()
+	}
+	if clientIP == "" {
+		return
+	}
+	if *policy.XForwardedFor {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if *policy.Forwarded {
+		// RFC 7239,IPv6 地址需要加方括号并用引号括起来
+		node := clientIP
+		if strings.Contains(clientIP, ":") {
+			node = `"[` + clientIP + `]"`
+		}
+		elem := "for=" + node + ";proto=http"
+		if req.Host != "" {
+			elem += `;host="` + req.Host + `"`
+		}
+		req.Header.Add("Forwarded", elem)
+	}
+}
+
+// applyResponseHeaderPolicy 按规则处理转发给客户端的响应头
+// 101 响应需要保留 Connection: Upgrade 和 Upgrade
+func applyResponseHeaderPolicy(resp *http.Response, policy HeaderPolicy) {
+	upgradeProto := resp.Header.Get("Upgrade")
+	removeHopByHopHeaders(resp.Header, *policy.StripHopByHop)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgradeProto)
+	}
+	if *policy.Via {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, policy.ViaName))
+	}
+}
+
+// requestHostname 返回请求的主机名,不包含端口
+func requestHostname(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// systemd socket activation 传递的第一个 fd
+const systemdListenFdsStart = 3
+
+// startListeners 打开所有监听器并开始接受连接,任何一个打开失败时关闭已经打开的并返回错误
+func startListeners(list []ListenerConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	var inherited []net.Listener
+	for _, lc := range list {
+		if lc.Network == "systemd" && inherited == nil {
+			var err error
+			if inherited, err = systemdListeners(); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+
+	handlers := make([]func(ctx context.Context, conn net.Conn), len(list))
+	for i, lc := range list {
+		handle, err := listenerHandler(lc)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listener %s %s: %v", lc.Network, lc.Addr, err)
+		}
+		handlers[i] = handle
+
+		l, err := openListener(lc, inherited)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("listener %s %s: %v", lc.Network, lc.Addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	for i, l := range listeners {
+		lc := list[i]
+		logrus.Infof("%s proxy server is running on %s %s tag: %q", listenerType(lc), l.Addr().Network(), l.Addr(), lc.Tag)
+		go serve(l, lc.Tag, handlers[i])
+	}
+	return listeners, nil
+}
+
+func listenerType(lc ListenerConfig) string {
+	if lc.Type == "" {
+		return "mixed"
+	}
+	return lc.Type
+}
+
+// listenerHandler 返回监听器类型对应的连接处理函数
+func listenerHandler(lc ListenerConfig) (func(ctx context.Context, conn net.Conn), error) {
+	switch listenerType(lc) {
+	case "mixed":
+		return handleMixedConn, nil
+	case "socks5":
+		return handleSocks5Request, nil
+	case "transparent":
+		return handleTransparentConn, nil
+	case "tls":
+		tlsConfig, err := newInboundTLSConfig(domainForwardMap.tlsInbound())
+		if err != nil {
+			return nil, err
+		}
+		return handleTLSConn(tlsConfig), nil
+	}
+	return nil, fmt.Errorf("unknown listener type %q", lc.Type)
+}
+
+// openListener 按 network 打开监听器,systemd 从 inherited 中按名字或序号选取
+func openListener(lc ListenerConfig, inherited []net.Listener) (net.Listener, error) {
+	switch lc.Network {
+	case "", "tcp":
+		return net.Listen("tcp", lc.Addr)
+	case "unix":
+		return listenUnix(lc.Addr, lc.Mode)
+	case "systemd":
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i, l := range inherited {
+			if l == nil {
+				continue
+			}
+			if (i < len(names) && names[i] == lc.Addr) || strconv.Itoa(i) == lc.Addr {
+				// 每个继承的 socket 只能被一个监听器使用
+				inherited[i] = nil
+				return l, nil
+			}
+		}
+		return nil, fmt.Errorf("no inherited socket named %q (LISTEN_FDNAMES=%q)", lc.Addr, os.Getenv("LISTEN_FDNAMES"))
+	}
+	return nil, fmt.Errorf("unknown listener network %q", lc.Network)
+}
+
+// listenUnix 监听 unix socket,删除上次运行遗留的 socket 文件
+func listenUnix(path, mode string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid mode %q: %v", mode, err)
+		}
+		if err := os.Chmod(path, fs.FileMode(perm)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// systemdListeners 取出 systemd socket activation 传递的 socket (sd_listen_fds)
+// 返回的切片下标就是 fd 的序号
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID=%q)", os.Getenv("LISTEN_PID"))
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS=%q)", os.Getenv("LISTEN_FDS"))
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(systemdListenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %d: %v", systemdListenFdsStart+i, err)
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
+
+// serve 接受 listener 上的连接,每个连接分配一个 reqID 并带上监听器的标签,交给 handle 处理
+func serve(listener net.Listener, tag string, handle func(ctx context.Context, conn net.Conn)) {
+	// 接受连接
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Errorln("Error accepting connection:", err)
+			continue
+		}
+		// 在读取任何数据之前按客户端地址检查 ACL
+		if reason := aclReject(tag, conn.RemoteAddr()); reason != "" {
+			logrus.Debugf("ACL 拒绝连接: listener: %q client: %s reason: %s", tag, conn.RemoteAddr(), reason)
+			listenerRejectedConnections.WithLabelValues(tag, reason).Inc()
+			conn.Close()
+			continue
+		}
+		reqID := uuid.New().String()
+		ctx := context.WithValue(context.Background(), requestIDKey, reqID)
+		ctx = context.WithValue(ctx, listenerTagKey, tag)
+
+		// 超过连接数或速率限制的连接交给处理函数回复错误,限制同时处理的数量并设置超时
+		release := func() {}
+		if connLimits != nil {
+			var reason string
+			if release, reason = connLimits.acquireConn(clientIP(conn.RemoteAddr())); reason != "" {
+				requestLogger(ctx).Warnf("超过连接限制 %s, 拒绝连接: client: %s", reason, conn.RemoteAddr())
+				connectionLimitRejected.WithLabelValues(reason).Inc()
+				if limitRejecting.Add(1) > limitMaxRejecting {
+					limitRejecting.Add(-1)
+					conn.Close()
+					continue
+				}
+				conn.SetDeadline(time.Now().Add(limitRejectTimeout))
+				go func(c net.Conn) {
+					defer limitRejecting.Add(-1)
+					handle(context.WithValue(ctx, limitRejectKey, reason), c)
+				}(conn)
+				continue
+			}
+		}
+		listenerConnections.WithLabelValues(tag).Inc()
+
+		// 处理 请求
+		go func(c net.Conn) {
+			defer release()
+			listenerActiveConnections.WithLabelValues(tag).Inc()
+			defer listenerActiveConnections.WithLabelValues(tag).Dec()
+			handle(ctx, c)
+		}(conn)
+	}
+}
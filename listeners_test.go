@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// unix socket 监听器: 删除遗留的 socket 文件,设置权限,连接和 TCP 一样处理
+func TestUnixListener(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over unix")
+	}))
+	defer web.Close()
+	withUpstreams(t, Config{})
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	// 上次运行遗留的 socket 文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lc := ListenerConfig{Network: "unix", Addr: path, Mode: "0600", Tag: "local"}
+	ln, err := openListener(lc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := listenerHandler(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, ln, lc.Tag, handle)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode = %o, want 600", perm)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if body, err := httpGetVia(conn, web.URL); err != nil || body != "over unix" {
+		t.Fatalf("body = %q, err = %v", body, err)
+	}
+}
+
+func TestUnixListenerRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := openListener(ListenerConfig{Network: "unix", Addr: path}, nil); err == nil {
+		l.Close()
+		t.Fatal("listening on a regular file succeeded")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Fatal("regular file was modified")
+	}
+}
+
+// systemd 传递的 socket 按 FileDescriptorName 或序号选取,每个只能使用一次
+func TestSystemdListenerSelection(t *testing.T) {
+	var inherited []net.Listener
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		inherited = append(inherited, l)
+	}
+	// openListener 会把用过的 socket 从 inherited 中清掉
+	first, second := inherited[0], inherited[1]
+	t.Setenv("LISTEN_FDNAMES", "web:admin")
+
+	l, err := openListener(ListenerConfig{Network: "systemd", Addr: "admin"}, inherited)
+	if err != nil || l != second {
+		t.Fatalf("by name: listener = %v, err = %v, want the second socket", l, err)
+	}
+	l, err = openListener(ListenerConfig{Network: "systemd", Addr: "0"}, inherited)
+	if err != nil || l != first {
+		t.Fatalf("by index: listener = %v, err = %v, want the first socket", l, err)
+	}
+	if _, err := openListener(ListenerConfig{Network: "systemd", Addr: "web"}, inherited); err == nil {
+		t.Fatal("the same inherited socket was used twice")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if _, err := systemdListeners(); err == nil {
+		t.Fatal("accepted sockets passed to another process")
+	}
+}
+
+// 规则的 listeners 只对这些标签的监听器接受的连接生效
+func TestRuleListenerFilter(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer web.Close()
+	host, _, _ := net.SplitHostPort(web.Listener.Addr().String())
+	withUpstreams(t, Config{Rules: []Rule{{DomainPattern: host, ForwardMethod: "block", Listeners: []string{"guest"}}}})
+
+	listen := func(tag string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		serveTestListener(t, ln, tag, handleMixedConn)
+		return ln.Addr().String()
+	}
+	office, guest := listen("office"), listen("guest")
+
+	if body, err := httpGetVia(dialTestProxy(t, office), web.URL); err != nil || body != "ok" {
+		t.Fatalf("office listener: body = %q, err = %v", body, err)
+	}
+	if body, err := httpGetVia(dialTestProxy(t, guest), web.URL); err == nil {
+		t.Fatalf("guest listener: got response %q, want the request blocked", body)
+	}
+}
+
+func TestStartListenersRejectsUnknownNetwork(t *testing.T) {
+	listeners, err := startListeners([]ListenerConfig{{Network: "sctp", Addr: "127.0.0.1:0"}})
+	if err == nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		t.Fatal("unknown network accepted")
+	}
+}
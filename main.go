@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -17,6 +21,30 @@ type contextKey string
 
 const requestIDKey contextKey = "requestID"
 
+// 客户端 mTLS 证书的 CN
+const clientCNKey contextKey = "clientCN"
+
+// 接受连接的监听器的标签
+const listenerTagKey contextKey = "listenerTag"
+
+// 通过代理认证(Proxy-Authorization 或 SOCKS5 用户名/密码)的用户名
+const proxyUserKey contextKey = "proxyUser"
+
+// requestLogger 返回带有 reqID 以及客户端身份(例如 mTLS 证书的 CN)的日志
+func requestLogger(ctx context.Context) *logrus.Entry {
+	log := logrus.WithField("reqID", ctx.Value(requestIDKey))
+	if tag, ok := ctx.Value(listenerTagKey).(string); ok && tag != "" {
+		log = log.WithField("listener", tag)
+	}
+	if cn, ok := ctx.Value(clientCNKey).(string); ok {
+		log = log.WithField("clientCN", cn)
+	}
+	if user, ok := ctx.Value(proxyUserKey).(string); ok {
+		log = log.WithField("user", user)
+	}
+	return log
+}
+
 // 判断一个IP地址是否在指定的范围内
 func isInRange(ipStr, startStr, endStr string) bool {
 	ip := net.ParseIP(ipStr)
@@ -32,58 +60,85 @@ func isInRange(ipStr, startStr, endStr string) bool {
 	return bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0
 }
 
-// 检查域名是否符合后缀匹配规则
-func getForwardMethodForHost(log *logrus.Entry, proxy_upstream, host, port, protocol string) (upstreamHost, method string) {
-	direct_upstream := host + ":" + port
-	// 遍历映射规则
-	for _, rule := range domainForwardMap.Rules {
+// matchRule 按配置顺序返回第一条匹配 host 的规则,没有匹配时返回 nil
+func matchRule(ctx context.Context, host string) *Rule {
+	tag, _ := ctx.Value(listenerTagKey).(string)
+	user := requestUser(ctx)
+	for i := range domainForwardMap.Rules {
+		rule := &domainForwardMap.Rules[i]
+		if len(rule.Listeners) > 0 && !slices.Contains(rule.Listeners, tag) {
+			continue
+		}
+		if (len(rule.Users) > 0 || len(rule.Groups) > 0) && !userMatches(user, rule.Users, rule.Groups) {
+			continue
+		}
 		//全局直连 用于纯粹的转发http流量
 		if rule.DomainPattern == "*" && rule.ForwardMethod == "direct" {
-			upstreamHost = direct_upstream
-			log.Infof("全局直连规则: protocol: %s host: %s method: %s upstream: %s", protocol, host, rule.ForwardMethod, upstreamHost)
-			method = rule.ForwardMethod
-			return
+			return rule
 		}
 
 		// 如果是通配符匹配（例如 *.douyu.cn）
 		if strings.HasPrefix(rule.DomainPattern, "*.") {
-
 			domainSuffix := rule.DomainPattern[2:]
 			// 检查域名后缀是否匹配,和*.domain相同的也能匹配上
 			if strings.HasSuffix(host, domainSuffix) {
-
-				switch rule.ForwardMethod {
-				case "direct":
-					upstreamHost = direct_upstream
-				case "block":
-					upstreamHost = ""
-					method = rule.ForwardMethod
-					log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, rule.ForwardMethod, upstreamHost)
-					return
-				default:
-					upstreamHost = proxy_upstream
-				}
-				log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, rule.ForwardMethod, upstreamHost)
-				return upstreamHost, rule.ForwardMethod
+				return rule
 			}
 		} else if host == rule.DomainPattern {
-			if rule.ForwardMethod == "direct" {
-				upstreamHost = direct_upstream
-			} else {
-				upstreamHost = proxy_upstream
-			}
 			// 精确匹配域名
-			log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, rule.ForwardMethod, upstreamHost)
+			return rule
+		}
+	}
+	return nil
+}
 
-			return upstreamHost, rule.ForwardMethod
+// 检查域名是否符合后缀匹配规则
+func getForwardMethodForHost(ctx context.Context, proxy_upstream, host, port, protocol string) (upstreamHost, method string) {
+	// DNS 查询很频繁,每个查询的路由结果只在 Debug 级别记录
+	logf := requestLogger(ctx).Infof
+	if protocol == "dns" {
+		logf = requestLogger(ctx).Debugf
+	}
+	direct_upstream := joinHostPort(host, port)
+	policy := matchUserPolicy(ctx)
+	if policy != nil && policy.Upstream != "" {
+		proxy_upstream = policy.Upstream
+	}
+	if rule := matchRule(ctx, host); rule != nil {
+		method = rule.ForwardMethod
+		switch method {
+		case "direct":
+			upstreamHost = direct_upstream
+		case "block":
+			upstreamHost = ""
+		default:
+			upstreamHost = proxy_upstream
 		}
+		if rule.DomainPattern == "*" {
+			logf("全局直连规则: protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
+		} else {
+			logf("protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
+		}
+		return
+	}
+
+	if policy != nil && policy.DefaultMethod != "" {
+		method = policy.DefaultMethod
+		switch method {
+		case "direct":
+			upstreamHost = direct_upstream
+		case "proxy":
+			upstreamHost = proxy_upstream
+		}
+		logf("用户策略默认路由: protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
+		return
 	}
 
 	if strings.HasPrefix(host, "192.168.") || strings.HasPrefix(host, "10.") || (strings.HasPrefix(host, "172.") && isInRange(host, "172.16.0.0", "172.31.255.255")) {
 		// 172.16.0.0 - 172.31.255.255 直连
 		// 如果 host 是以 192.168. 或 10. 开头的内网 IP，使用直连规则
 		upstreamHost = direct_upstream
-		log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, "direct", upstreamHost)
+		logf("protocol: %s host: %s method: %s upstream: %s", protocol, host, "direct", upstreamHost)
 		return upstreamHost, "direct"
 	}
 
@@ -94,36 +149,133 @@ func getForwardMethodForHost(log *logrus.Entry, proxy_upstream, host, port, prot
 		if host == "1.1.1.1" || host == "8.8.8.8" {
 			upstreamHost = proxy_upstream
 			method = "proxy"
-			log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
+			logf("protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
 			return
 		} else {
 			upstreamHost = direct_upstream
 			method = "direct"
-			log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
+			logf("protocol: %s host: %s method: %s upstream: %s", protocol, host, method, upstreamHost)
 			return
 		}
 	}
 
 	// 默认使用代理
-	log.Infof("protocol: %s host: %s method: %s upstream: %s", protocol, host, "proxy", proxy_upstream)
+	logf("protocol: %s host: %s method: %s upstream: %s", protocol, host, "proxy", proxy_upstream)
 	return proxy_upstream, "proxy"
 }
-func handleConnectRequest(ctx context.Context, conn net.Conn) {
-	log := logrus.WithField("reqID", ctx.Value(requestIDKey))
-	reqLine, body, err := readRequestHeaderAndBody(conn)
+
+// handleMixedConn 根据连接的第一个字节区分协议,同一个端口同时提供 HTTP 和 SOCKS4/5 代理
+// 0x05 为 SOCKS5,0x04 为 SOCKS4/4a,其它都按 HTTP 处理
+func handleMixedConn(ctx context.Context, conn net.Conn) {
+	log := requestLogger(ctx)
+	// 只是查看第一个字节,数据仍然留在读缓冲中交给对应的协议处理
+	bc := newBufferedConn(conn)
+	first, err := bc.Peek(1)
 	if err != nil {
-		log.Errorf("Failed to read request: %v", err)
+		log.Debugf("客户端未发送数据就关闭了连接: %v", err)
+		conn.Close()
 		return
 	}
+	switch first[0] {
+	case socks5Version:
+		handleSocks5Request(ctx, bc)
+	case socks4Version:
+		handleSocks4Request(ctx, bc)
+	default:
+		handleConnectRequest(ctx, bc)
+	}
+}
+
+// handleConnectRequest 处理一个客户端连接
+// 普通 HTTP 请求在客户端允许时复用连接,依次处理后续的请求(包括 pipelining),
+// 每个请求单独做路由并使用自己的 reqID;CONNECT 隧道占用整个连接
+func handleConnectRequest(ctx context.Context, conn net.Conn) {
+	keepAlive := domainForwardMap.clientKeepAlive()
+	// 整个请求处理过程共用连接的读缓冲,解析请求头时多读的数据
+	// (下一个 pipelining 请求、请求体、紧跟在 CONNECT 后面的 ClientHello)都不会丢失
+	bc := newBufferedConn(conn)
+	connCtx := ctx
+	for n := 1; ; n++ {
+		if n > 1 {
+			ctx = context.WithValue(connCtx, requestIDKey, uuid.New().String())
+			// 等待下一个请求的空闲超时
+			conn.SetReadDeadline(time.Now().Add(keepAlive.IdleTimeout))
+		}
+		if !handleRequest(ctx, bc, n > 1) {
+			return
+		}
+		if keepAlive.Disable || (keepAlive.MaxRequests > 0 && n >= keepAlive.MaxRequests) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// handleRequest 读取并处理连接上的一个请求,返回 true 表示可以继续读取下一个请求
+// 返回 false 时连接已经关闭
+func handleRequest(ctx context.Context, conn *bufferedConn, idle bool) bool {
+	log := requestLogger(ctx)
+	reject := limitRejection(ctx)
+	if reject != "" {
+		// TLS 握手等可能已经清除了超时
+		conn.SetReadDeadline(time.Now().Add(limitRejectTimeout))
+	}
+	reqLine, err := readRequestHead(conn.br)
+	if err != nil {
+		var netErr net.Error
+		if idle && (errors.Is(err, io.EOF) || errors.As(err, &netErr) && netErr.Timeout()) {
+			// 客户端关闭了空闲连接或者空闲超时
+			log.Debug("客户端连接空闲结束")
+		} else {
+			log.Errorf("Failed to read request: %v", err)
+		}
+		conn.Close()
+		return false
+	}
+	if reject != "" {
+		writeLimitResponse(conn, reject)
+		conn.Close()
+		return false
+	}
+	conn.SetReadDeadline(time.Time{})
 	log.Debugf("reqLine :\n %s\n", reqLine)
 	// 解析出目标主机和端口
 	// 格式为 CONNECT www.google.com:443 HTTP/1.1
 	parts := strings.Split(reqLine, " ")
 	if len(parts) < 3 {
 		log.Errorf("Invalid CONNECT request format,reqLine: %s", reqLine)
-		return
+		conn.Close()
+		return false
 	}
 
+	if proxyAuth != nil {
+		user, err := proxyAuth.authenticate(reqLine)
+		if err != nil {
+			reason := "invalid"
+			if errors.Is(err, errProxyAuthMissing) {
+				reason = "missing"
+			}
+			log.Warnf("代理认证失败: %v", err)
+			proxyAuthFailures.WithLabelValues(reason).Inc()
+			if !writeProxyAuthRequired(conn, reqLine, proxyAuth.cfg.Realm) {
+				conn.Close()
+				return false
+			}
+			return true
+		}
+		ctx = context.WithValue(ctx, proxyUserKey, user)
+		log = requestLogger(ctx)
+		// Proxy-Authorization 是发给本代理的,不转发给上游
+		reqLine = removeRequestHeader(reqLine, "Proxy-Authorization")
+	}
+	release := acquireUserLimit(ctx)
+	if release == nil {
+		writeLimitResponse(conn, limitPerUser)
+		conn.Close()
+		return false
+	}
+	defer release()
+
 	method := parts[0]
 	target := parts[1]
 	// 根据请求方法处理
@@ -132,6 +284,7 @@ func handleConnectRequest(ctx context.Context, conn net.Conn) {
 	case "CONNECT":
 		log.Debug("处理CONNECT请求，转发给HTTPS上游")
 		handleConnectRequest_https(ctx, conn, target, reqLine)
+		return false
 		//除了CONNECT其余的都是http的协议，转给http的上游
 
 	default:
@@ -143,23 +296,29 @@ func handleConnectRequest(ctx context.Context, conn net.Conn) {
 			log.Debug("处理HTTPS请求，转发给HTTPS上游")
 			// 然后调用 https 请求的处理函数
 			handleConnectRequest_https(ctx, conn, target, reqLine)
-			return
+			return false
 		}
 		log.Debug("处理HTTP请求，转发给HTTP上游")
-		req, err := createHTTPRequest(reqLine, body)
+		req, err := createHTTPRequest(reqLine, conn.br)
 		if err != nil {
 			log.Errorf("Failed to create HTTP request: %v", err)
-			return
+			conn.Close()
+			return false
 		}
 		// 注入context
 		req = req.WithContext(ctx)
-		handleConnectRequest_http(conn, req)
+		if !handleConnectRequest_http(conn, req) {
+			conn.Close()
+			return false
+		}
+		return true
 	}
 }
 
 var domainForwardMap Config
-var proxyAddr *string
-var proxyAddrbak *string
+
+// 所有 proxy 上游,按优先级排列
+var upstreams *upstreamManager
 
 func loglevel_set(loglevel *string) {
 	if *loglevel == "info" || *loglevel == "Info" {
@@ -176,13 +335,16 @@ var version = ""
 
 func main() {
 	// 解析命令行参数
-	listenAddr := flag.String("listen", ":8080", "监听地址，格式为[host]:port")
-	proxyAddr = flag.String("proxy", "127.0.0.1:8079", "监听地址，格式为[host]:port")
-	proxyAddrbak = flag.String("proxybak", "127.0.0.1:8078", "监听地址，格式为[host]:port,这是备份的proxy上游，可以为空")
+	listenAddr := flag.String("listen", ":8080", "监听地址，格式为[host]:port,同时支持 HTTP 和 SOCKS4/5")
+	proxyAddr := flag.String("proxy", "127.0.0.1:8079", "监听地址，格式为[host]:port")
+	proxyAddrbak := flag.String("proxybak", "127.0.0.1:8078", "监听地址，格式为[host]:port,这是备份的proxy上游，可以为空")
 	loglevel := flag.String("log", "Info", "日志等级 Info Debug")
 	enable_pprof := flag.Bool("enable_pprof", false, "是否启用pprof")
 	isversion := flag.Bool("version", false, "是否显示版本")
 	listenAddr_prometheus := flag.String("listen_prometheus", ":9988", "prometheus 指标 监听地址，格式为:port")
+	listenAddr_socks5 := flag.String("listen_socks5", "", "SOCKS5 监听地址，格式为[host]:port,为空时不启用")
+	listenAddr_tls := flag.String("listen_tls", "", "TLS 监听地址，格式为[host]:port,为空时不启用,证书在配置文件的 tls 中设置")
+	listenAddr_transparent := flag.String("listen_transparent", "", "透明代理监听地址(配合 iptables REDIRECT,仅支持 Linux)，格式为[host]:port,为空时不启用")
 
 	flag.Parse()
 	if *isversion {
@@ -198,20 +360,46 @@ func main() {
 	}
 	loglevel_set(loglevel)
 
+	// 健康检查需要用到配置文件中的上游配置,因此先加载配置
+	domainForwardMap = LoadConfig()
+	if err := initResolvers(&domainForwardMap); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := checkUserPolicies(&domainForwardMap); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := initACL(domainForwardMap.ACL); err != nil {
+		logrus.Fatal(err)
+	}
+	if limits := domainForwardMap.Limits; limits.enabled() {
+		connLimits = newConnLimiter(limits)
+	}
+	if err := initBandwidth(&domainForwardMap); err != nil {
+		logrus.Fatal(err)
+	}
+	auth, err := newProxyAuthenticator(domainForwardMap.proxyAuth())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	proxyAuth = auth
+
 	// 检查 proxyAddr 是ip:port还是域名:port
-	err := checkProxyAddr(proxyAddr)
+	err = checkProxyAddr(proxyAddr)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	if *proxyAddrbak != "" {
-		//使用备份上游
-		err := checkProxyAddr(proxyAddrbak)
-		if err != nil {
-			logrus.Fatal(err)
-		}
-		go setup_proxy_bak()
+	//使用备份上游
+	err = checkProxyAddr(proxyAddrbak)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	upstreams, err = newUpstreamManager(&domainForwardMap, *proxyAddr, *proxyAddrbak)
+	if err != nil {
+		logrus.Fatal(err)
 	}
+	upstreams.startHealthChecks()
+	httpConnPool = newConnPool(domainForwardMap.upstreamPool())
 
 	// 设置输出到标准输出
 	logrus.SetOutput(os.Stdout)
@@ -225,36 +413,45 @@ func main() {
 		}
 	}()
 
-	domainForwardMap = LoadConfig()
+	// 命令行参数指定的监听器和配置文件中的监听器
+	// 配置文件中有监听器时,只有显式指定了 -listen 才会监听 -listen 的地址
+	listenSet := false
+	flag.Visit(func(f *flag.Flag) {
+		listenSet = listenSet || f.Name == "listen"
+	})
+	var listenerConfigs []ListenerConfig
+	if *listenAddr != "" && (len(domainForwardMap.Listeners) == 0 || listenSet) {
+		listenerConfigs = append(listenerConfigs, ListenerConfig{Addr: *listenAddr})
+	}
+	if *listenAddr_socks5 != "" {
+		listenerConfigs = append(listenerConfigs, ListenerConfig{Addr: *listenAddr_socks5, Type: "socks5"})
+	}
+	if *listenAddr_tls != "" {
+		listenerConfigs = append(listenerConfigs, ListenerConfig{Addr: *listenAddr_tls, Type: "tls"})
+	}
+	if *listenAddr_transparent != "" {
+		listenerConfigs = append(listenerConfigs, ListenerConfig{Addr: *listenAddr_transparent, Type: "transparent"})
+	}
+	listenerConfigs = append(listenerConfigs, domainForwardMap.Listeners...)
+	if len(listenerConfigs) == 0 && domainForwardMap.DNS.Listen == "" {
+		logrus.Fatal("没有配置任何监听器")
+	}
+
+	if dnsCfg := domainForwardMap.dnsServer(); dnsCfg.Listen != "" {
+		if err := newDNSServer(dnsCfg).start(); err != nil {
+			logrus.Fatal("Error starting DNS server:", err)
+		}
+		logrus.Infof("DNS server is running on %s tag: %q", dnsCfg.Listen, dnsCfg.Tag)
+	}
 
 	// 启动代理服务，监听指定地址
-	listener, err := net.Listen("tcp", *listenAddr)
-	if err != nil {
+	if _, err := startListeners(listenerConfigs); err != nil {
 		logrus.Errorln("Error starting server:", err)
 		fmt.Println("Error starting server:", err)
 		return
 	}
 
-	defer listener.Close()
-
-	hello := fmt.Sprintf("Proxy server is running on %s", *listenAddr)
-	logrus.Info(hello)
-
-	// 接受连接
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logrus.Errorln("Error accepting connection:", err)
-			continue
-		}
-
-		// 处理 请求
-		go func(c net.Conn) {
-			reqID := uuid.New().String()
-			ctx := context.WithValue(context.Background(), requestIDKey, reqID)
-			handleConnectRequest(ctx, c)
-		}(conn)
-	}
+	select {}
 }
 
 func checkProxyAddr(proxyAddr *string) error {
@@ -264,24 +461,10 @@ func checkProxyAddr(proxyAddr *string) error {
 		//因为全局直连功能不需要上游,因此可能配置上游为空
 		return nil
 	}
-	host, port, err := net.SplitHostPort(*proxyAddr)
+	// 域名形式的上游保持原样,由 upstreamManager 定期重新解析
+	_, _, err := net.SplitHostPort(*proxyAddr)
 	if err != nil {
 		return fmt.Errorf("failed to split host and port from proxy address: %v", err)
 	}
-
-	// 尝试将主机部分解析为 IP 地址
-	ip := net.ParseIP(host)
-	if ip != nil {
-		*proxyAddr = ip.String() + ":" + port
-		return nil
-	}
-
-	// 如果不是 IP，则认为是域名
-
-	addr, err := net.ResolveIPAddr("ip4", host)
-	if err != nil {
-		return fmt.Errorf("failed to lookup host: %v", err)
-	}
-	*proxyAddr = addr.String() + ":" + port
 	return nil
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// 测试中不输出日志
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func discardLog() *logrus.Entry {
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// httpGetVia 通过 conn 发送普通 HTTP 请求,返回响应体,代理没有回复时返回错误
+func httpGetVia(conn net.Conn, rawURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// 混合端口按第一个字节识别 SOCKS5、SOCKS4 和 HTTP
+func TestMixedPortDetectsProtocol(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "web")
+	}))
+	defer web.Close()
+	echo := startTCPStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	host, portStr, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(portStr)
+	withUpstreams(t, Config{})
+	proxy := startTestProxy(t)
+
+	t.Run("http", func(t *testing.T) {
+		body, err := httpGetVia(dialTestProxy(t, proxy), web.URL)
+		if err != nil || body != "web" {
+			t.Fatalf("body = %q, err = %v", body, err)
+		}
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+		if got := readReply(t, conn, 2); got[1] != socks5AuthNone {
+			t.Fatalf("method selection = %v, want no auth", got)
+		}
+		if rep := socks5ConnectIPv4(t, conn, echo); rep != socks5RepSuccess {
+			t.Fatalf("CONNECT reply = %d", rep)
+		}
+		conn.Write([]byte("five"))
+		if got := readReply(t, conn, 4); string(got) != "five" {
+			t.Fatalf("echo = %q", got)
+		}
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		req := []byte{socks4Version, socks4CmdConnect}
+		req = binary.BigEndian.AppendUint16(req, uint16(port))
+		req = append(req, net.ParseIP(host).To4()...)
+		req = append(req, 0)
+		conn.Write(req)
+		if rep := readReply(t, conn, 8); rep[1] != socks4RepGranted {
+			t.Fatalf("SOCKS4 reply = %#x, want granted", rep[1])
+		}
+		conn.Write([]byte("four"))
+		if got := readReply(t, conn, 4); string(got) != "four" {
+			t.Fatalf("echo = %q", got)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// netfilter 定义的 SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// originalDst 取出被 iptables REDIRECT / TPROXY 重定向之前的目标地址
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original destination: not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// 返回的是 sockaddr_in6,借用 IPv6MTUInfo 的内存布局读取
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// Port 在内存中是网络字节序
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			return
+		}
+		// 返回的是 sockaddr_in,借用 IPv6Mreq 的内存布局读取
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// sockaddr_in: family(2) port(2) addr(4)
+		b := mreq.Multiaddr
+		addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %v", sockErr)
+	}
+	return addr, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// originalDst 透明代理依赖 netfilter,只支持 Linux
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxy is not supported on %s", runtime.GOOS)
+}
@@ -32,6 +32,136 @@ var (
 		Name: "http_direct_upload_bytes_total",
 		Help: "Total bytes uploaded directly.",
 	})
+
+	// 上游主动健康检查结果 1 正常 0 异常
+	upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_upstream_healthy",
+		Help: "Whether the upstream passes active health checks (1 healthy, 0 unhealthy).",
+	}, []string{"upstream"})
+
+	// 上游熔断器状态 0 closed 1 open 2 half-open
+	upstreamBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_upstream_breaker_state",
+		Help: "Circuit breaker state of the upstream (0 closed, 1 open, 2 half-open).",
+	}, []string{"upstream"})
+
+	upstreamBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_upstream_breaker_transitions_total",
+		Help: "Total circuit breaker state changes of the upstream, by new state.",
+	}, []string{"upstream", "state"})
+
+	upstreamPassiveFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_upstream_request_failures_total",
+		Help: "Total dial/CONNECT failures of real requests sent to the upstream.",
+	}, []string{"upstream"})
+
+	// 普通 HTTP 转发时上游连接池的命中情况
+	upstreamPoolRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_upstream_pool_requests_total",
+		Help: "Total upstream connection pool lookups for plain HTTP, by result (hit/miss).",
+	}, []string{"result"})
+
+	upstreamPoolIdle = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_proxy_upstream_pool_idle_conns",
+		Help: "Number of idle upstream connections in the pool.",
+	})
+
+	// 每个监听器接受的连接
+	listenerConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_listener_connections_total",
+		Help: "Total connections accepted, by listener tag.",
+	}, []string{"listener"})
+
+	listenerActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_listener_active_connections",
+		Help: "Number of connections currently being handled, by listener tag.",
+	}, []string{"listener"})
+
+	listenerRejectedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_listener_rejected_connections_total",
+		Help: "Total connections rejected by the client IP ACL, by listener tag and reason (denied/not_allowed).",
+	}, []string{"listener", "reason"})
+
+	// 连接数和速率限制,limit 为 global / per_ip / per_user / rate / rate_per_ip
+	connectionLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_connection_limit",
+		Help: "Configured connection limits (0 means unlimited), by limit.",
+	}, []string{"limit"})
+
+	connectionLimitUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_connection_limit_usage",
+		Help: "Current usage of each connection limit: connections for global, the busiest client for per_ip/per_user, new connections in the last second for rate.",
+	}, []string{"limit"})
+
+	connectionLimitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_connection_limit_rejected_total",
+		Help: "Total connections and requests rejected by connection limits, by limit.",
+	}, []string{"limit"})
+
+	bandwidthDelay = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_bandwidth_delay_seconds_total",
+		Help: "Total time connections waited for bandwidth tokens, by direction (upload/download).",
+	}, []string{"direction"})
+
+	// 内置 DNS 服务
+	dnsQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_dns_queries_total",
+		Help: "Total DNS queries answered, by forward method and cache result (hit/miss).",
+	}, []string{"method", "cache"})
+
+	dnsUpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_dns_upstream_errors_total",
+		Help: "Total failed queries to DNS servers, by forward method.",
+	}, []string{"method"})
+
+	dnsUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_proxy_dns_upstream_duration_seconds",
+		Help:    "Latency of successful queries to DNS servers, by forward method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	dnsCacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_proxy_dns_cache_entries",
+		Help: "Number of cached DNS responses, by cache (dns for the DNS server, resolver/<name> for direct resolvers).",
+	}, []string{"cache"})
+
+	// HTTP 代理认证失败的请求,reason 为 missing(没有 Proxy-Authorization) / invalid
+	proxyAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_auth_failures_total",
+		Help: "Total requests rejected with 407, by reason.",
+	}, []string{"reason"})
+
+	// 直连使用的解析器
+	resolverQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_resolver_queries_total",
+		Help: "Total lookups by direct resolvers, by resolver, query type and cache result (hit/miss).",
+	}, []string{"resolver", "qtype", "cache"})
+
+	resolverErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_resolver_errors_total",
+		Help: "Total failed queries to DNS servers by direct resolvers, by resolver.",
+	}, []string{"resolver"})
+
+	// SOCKS5 UDP 转发流量 (字节),不包含 SOCKS5 UDP 头
+	udpUploadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_udp_upload_bytes_total",
+		Help: "Total UDP payload bytes sent from clients, by forward method.",
+	}, []string{"method"})
+
+	udpDownloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_udp_download_bytes_total",
+		Help: "Total UDP payload bytes sent back to clients, by forward method.",
+	}, []string{"method"})
+
+	udpDroppedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_proxy_udp_dropped_packets_total",
+		Help: "Total UDP datagrams dropped, by reason.",
+	}, []string{"reason"})
+
+	udpNATEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "http_proxy_udp_nat_entries",
+		Help: "Number of active SOCKS5 UDP NAT table entries.",
+	})
 )
 
 // main 	http.Handle("/metrics", promhttp.Handler())
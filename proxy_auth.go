@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// proxyAuth 为 nil 时不需要认证
+var proxyAuth *proxyAuthenticator
+
+var (
+	errProxyAuthMissing = errors.New("missing Proxy-Authorization")
+	errProxyAuthInvalid = errors.New("invalid username or password")
+)
+
+// proxyAuthenticator 校验 Proxy-Authorization: Basic
+// 用户来自配置文件和 htpasswd 文件,htpasswd 文件修改后重新加载
+type proxyAuthenticator struct {
+	cfg ProxyAuth
+
+	mu       sync.RWMutex
+	htpasswd map[string][]byte // 用户名 -> bcrypt hash
+	modTime  time.Time
+	size     int64
+	// 已经校验通过的 用户名 -> sha256(密码),bcrypt 很慢,同一个用户的后续请求不再计算
+	// 重新加载 htpasswd 时清空
+	verified map[string][sha256.Size]byte
+}
+
+// newProxyAuthenticator 没有配置任何用户时返回 nil
+func newProxyAuthenticator(cfg ProxyAuth) (*proxyAuthenticator, error) {
+	if len(cfg.Users) == 0 && cfg.HtpasswdFile == "" {
+		return nil, nil
+	}
+	a := &proxyAuthenticator{cfg: cfg, verified: make(map[string][sha256.Size]byte)}
+	if cfg.HtpasswdFile != "" {
+		if err := a.reload(); err != nil {
+			return nil, err
+		}
+		go a.watch()
+	}
+	return a, nil
+}
+
+// watch 定期检查 htpasswd 文件,修改时间或者大小变化时重新加载
+// 加载失败时保留之前的用户
+func (a *proxyAuthenticator) watch() {
+	ticker := time.NewTicker(a.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.reload(); err != nil {
+			logrus.Errorf("重新加载 htpasswd 文件 %s 失败: %v", a.cfg.HtpasswdFile, err)
+		}
+	}
+}
+
+func (a *proxyAuthenticator) reload() error {
+	fi, err := os.Stat(a.cfg.HtpasswdFile)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	unchanged := a.htpasswd != nil && fi.ModTime().Equal(a.modTime) && fi.Size() == a.size
+	a.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(a.cfg.HtpasswdFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.htpasswd = users
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+	a.verified = make(map[string][sha256.Size]byte)
+	a.mu.Unlock()
+	logrus.Infof("已加载 htpasswd 文件 %s, %d 个用户", a.cfg.HtpasswdFile, len(users))
+	return nil
+}
+
+// parseHtpasswd 解析 用户名:hash 格式的行,跳过空行和 # 开头的注释
+// 不是 bcrypt 的 hash(例如 MD5 的 $apr1$)记录警告后忽略
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: invalid format", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			logrus.Warnf("htpasswd 第 %d 行用户 %q 的密码不是 bcrypt 格式,已忽略", n, username)
+			continue
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// authenticate 校验请求头中的 Proxy-Authorization,返回用户名
+func (a *proxyAuthenticator) authenticate(reqLine string) (string, error) {
+	value := requestHeader(reqLine, "Proxy-Authorization")
+	if value == "" {
+		return "", errProxyAuthMissing
+	}
+	username, password, ok := parseBasicAuth(value)
+	if !ok {
+		return "", fmt.Errorf("%w: malformed credentials", errProxyAuthInvalid)
+	}
+	if !a.check(username, password) {
+		return "", fmt.Errorf("%w for user %q", errProxyAuthInvalid, username)
+	}
+	return username, nil
+}
+
+func (a *proxyAuthenticator) check(username, password string) bool {
+	for _, u := range a.cfg.Users {
+		if u.Username == username && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	a.mu.RLock()
+	hash, ok := a.htpasswd[username]
+	cached, verified := a.verified[username]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if verified && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	// 校验期间文件可能已经重新加载,只有 hash 没变时才记录
+	if string(a.htpasswd[username]) == string(hash) {
+		a.verified[username] = sum
+	}
+	a.mu.Unlock()
+	return true
+}
+
+// parseBasicAuth 解析 "Basic base64(用户名:密码)"
+func parseBasicAuth(value string) (username, password string, ok bool) {
+	scheme, credentials, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// writeProxyAuthRequired 回复 407,返回 true 表示客户端连接可以继续读取下一个请求
+// 请求带有请求体时没有读取请求体,只能关闭连接
+func writeProxyAuthRequired(conn net.Conn, reqLine, realm string) bool {
+	contentLength := requestHeader(reqLine, "Content-Length")
+	keepAlive := (contentLength == "" || contentLength == "0") && requestHeader(reqLine, "Transfer-Encoding") == ""
+	resp := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+		"Proxy-Authenticate: Basic realm=" + quoteHeaderValue(realm) + ", charset=\"UTF-8\"\r\n" +
+		"Content-Length: 0\r\n"
+	if !keepAlive {
+		resp += "Connection: close\r\n"
+	}
+	resp += "\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return false
+	}
+	return keepAlive
+}
+
+// quoteHeaderValue 把 s 转为 HTTP quoted-string
+func quoteHeaderValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// requestHeader 返回请求头文本中第一个名为 name 的头部的值
+func requestHeader(reqLine, name string) string {
+	lines := strings.Split(reqLine, "\r\n")
+	for _, line := range lines[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// removeRequestHeader 删除请求头文本中所有名为 name 的头部
+func removeRequestHeader(reqLine, name string) string {
+	lines := strings.Split(reqLine, "\r\n")
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		if k, _, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\r\n")
+}
@@ -3,185 +3,236 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"fmt"
 	"net"
-	"strings"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func setup_proxy_bak() {
-	// 写一个定时器
-	// 每分钟检测一次上游是否正常，如果不正常，使用 proxyAddrbak 替换  proxyAddr
-	// 替换之前先使用 check_upstream_hc 函数检测一下proxyAddrbak是否正常，不正常还是不替换了
-	ticker := time.NewTicker(10 * time.Second)
+// healthProbe 执行一次探测,返回 nil 表示上游正常
+type healthProbe func(addr string, hc HealthCheck) error
+
+// 可用的探测方式,新增方式只需要在这里注册
+var healthProbes = map[string]healthProbe{
+	"tcp":     probeTCP,
+	"connect": probeConnect,
+	"https":   probeHTTPS,
+}
+
+// upstreamHealth 记录单个上游的健康状态
+type upstreamHealth struct {
+	addr  string
+	addrs *upstreamAddrs
+	hc    HealthCheck
+	cb    CircuitBreaker
+
+	mu        sync.Mutex
+	healthy   bool
+	successes int // 连续成功次数
+	failures  int // 连续失败次数
+
+	// 被动检查: 真实请求的连续失败次数和熔断器状态
+	passiveFailures int
+	breaker         string
+	breakerSince    time.Time
+	probing         bool // half-open 状态已经放行了探测请求,还没有结果
+	probeSince      time.Time
+}
+
+func newUpstreamHealth(addr string, addrs *upstreamAddrs, hc HealthCheck, cb CircuitBreaker) *upstreamHealth {
+	// 启动时认为上游是健康的,连续失败 fall 次后才判定为异常
+	upstreamHealthy.WithLabelValues(addr).Set(1)
+	upstreamBreakerState.WithLabelValues(addr).Set(breakerStateValue[breakerClosed])
+	return &upstreamHealth{addr: addr, addrs: addrs, hc: hc, cb: cb, healthy: true, breaker: breakerClosed}
+}
+
+func (u *upstreamHealth) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// record 记录一次探测结果,健康状态发生变化时返回 true
+func (u *upstreamHealth) record(ok bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.successes++
+		u.failures = 0
+		if !u.healthy && u.successes >= u.hc.Rise {
+			u.healthy = true
+			upstreamHealthy.WithLabelValues(u.addr).Set(1)
+			return true
+		}
+	} else {
+		u.failures++
+		u.successes = 0
+		if u.healthy && u.failures >= u.hc.Fall {
+			u.healthy = false
+			upstreamHealthy.WithLabelValues(u.addr).Set(0)
+			return true
+		}
+	}
+	return false
+}
+
+// run 按配置的间隔持续探测,状态变化时调用 onChange,done 关闭时停止
+func (u *upstreamHealth) run(done <-chan struct{}, onChange func(u *upstreamHealth)) {
+	ticker := time.NewTicker(u.hc.Interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		// 检测上游是否正常
-		if !check_upstream_hc(*proxyAddr) {
-			logrus.Warn("上游 ", *proxyAddr, " 异常，尝试切换到备份上游 ", *proxyAddrbak)
-			// 检测 proxyAddrbak 是否正常
-			if check_upstream_hc(*proxyAddrbak) {
-				logrus.Info("备份上游 ", *proxyAddrbak, " 正常，切换")
-				// 替换 proxyAddr
-				temp := *proxyAddr
-				*proxyAddr = *proxyAddrbak
-				*proxyAddrbak = temp
-				logrus.Info("已将 proxyAddr 切换为 ", *proxyAddr, "，proxyAddrbak 切换为 ", *proxyAddrbak)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if u.record(check_upstream_hc(u.addr, u.hc)) {
+			if u.isHealthy() {
+				logrus.Info("上游 ", u.addr, " 恢复正常")
 			} else {
-				logrus.Error("备份上游 ", *proxyAddrbak, " 也不正常，不进行切换")
+				logrus.Warn("上游 ", u.addr, " 连续 ", u.hc.Fall, " 次检查失败,判定为异常")
 			}
-		} else {
-			logrus.Debug("上游 ", *proxyAddr, " 正常")
+			onChange(u)
 		}
 	}
 }
-func check_upstream_hc(http_upstream_addr string) bool {
-	// 1. 连接到代理服务器
-	upstreamConn, err := net.DialTimeout("tcp", http_upstream_addr, 10*time.Second) // 增加超时
-	if err != nil {
-		logrus.Errorln("Error connecting to upstream proxy:", err)
-		return false
-	}
-	defer upstreamConn.Close()
 
-	// 2. 发送 CONNECT 请求到代理
-	var sb strings.Builder
-	sb.WriteString("CONNECT www.google.com:443 HTTP/1.1\r\n")
-	sb.WriteString("Host: www.google.com:443\r\n")
-	sb.WriteString("User-Agent: curl/7.88.1\r\n") // 与您的curl一致
-	sb.WriteString("Proxy-Connection: Keep-Alive\r\n")
-	sb.WriteString("\r\n")
-	connectReq := sb.String()
-
-	logrus.Debugln("Sending CONNECT request:\n", connectReq)
-	_, err = upstreamConn.Write([]byte(connectReq))
-	if err != nil {
-		logrus.Errorln("Error sending CONNECT to upstream proxy:", err)
+func check_upstream_hc(http_upstream_addr string, hc HealthCheck) bool {
+	probe, ok := healthProbes[hc.Kind]
+	if !ok {
+		logrus.Errorf("未知的健康检查方式 %q", hc.Kind)
 		return false
 	}
-
-	// 3. 读取代理对 CONNECT 请求的响应
-	// 简单的响应读取，仅用于示例。生产代码应使用更健壮的HTTP响应解析。
-	proxyReader := bufio.NewReader(upstreamConn)
-	statusLine, err := proxyReader.ReadString('\n')
+	err := probe(http_upstream_addr, hc)
 	if err != nil {
-		logrus.Errorln("Error reading status line from proxy:", err)
+		logrus.Errorf("上游 %s 健康检查(%s)失败: %v", http_upstream_addr, hc.Kind, err)
 		return false
 	}
-	logrus.Debugln("Proxy CONNECT response status line:", strings.TrimSpace(statusLine))
+	logrus.Debugf("上游 %s 健康检查(%s)正常", http_upstream_addr, hc.Kind)
+	return true
+}
 
-	if !strings.Contains(statusLine, " 200 ") { // 检查是否包含 " 200 " 而不仅仅是 "200 OK" 因为有些代理可能返回 "200 Connection established"
-		logrus.Errorln("Proxy CONNECT request failed:", strings.TrimSpace(statusLine))
-		// 读取并打印更多代理的响应（如果有）
-		for {
-			headerLine, err := proxyReader.ReadString('\n')
-			if err != nil || headerLine == "\r\n" {
-				break
-			}
-			logrus.Debugln("Proxy response header:", strings.TrimSpace(headerLine))
-		}
-		return false
+// probeTarget 解析探测 URL,返回 CONNECT 的目标 host:port,没有端口时按 scheme 补上默认端口
+func probeTarget(hc HealthCheck) (target string, u *url.URL, err error) {
+	u, err = url.Parse(hc.URL)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid health check url %q: %v", hc.URL, err)
 	}
-
-	// 读取并丢弃 CONNECT 响应的剩余头部，直到空行
-	for {
-		line, err := proxyReader.ReadString('\n')
-		if err != nil {
-			logrus.Errorln("Error reading proxy CONNECT response headers:", err)
-			return false
-		}
-		if line == "\r\n" { // HTTP头部结束
-			break
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
 		}
 	}
-	logrus.Debug("Proxy tunnel established.")
+	return net.JoinHostPort(u.Hostname(), port), u, nil
+}
 
-	// 4. 在已建立的隧道上进行TLS握手
-	tlsConfig := &tls.Config{
-		ServerName:         "www.google.com", // SNI (Server Name Indication)
-		InsecureSkipVerify: false,            // 在生产环境中不要设置为true，除非您知道自己在做什么
-		MinVersion:         tls.VersionTLS12, // 建议设置最低TLS版本
+func probeTCP(addr string, hc HealthCheck) error {
+	conn, err := dialUpstream(addr, hc.Timeout)
+	if err != nil {
+		return err
 	}
-	// upstreamConn 现在是通往 www.google.com:443 的TCP连接
-	// 我们需要在此连接上启动TLS客户端握手
-	tlsConn := tls.Client(upstreamConn, tlsConfig)
+	return conn.Close()
+}
 
-	// 设置握手超时
-	// Go的net.Conn没有直接的SetHandshakeDeadline，但tls.Conn的Handshake会使用底层的超时
-	// 或者，可以在一个goroutine中执行Handshake并通过channel和timer来控制超时
-	err = upstreamConn.SetDeadline(time.Now().Add(10 * time.Second)) // 为握手设置超时
+func probeConnect(addr string, hc HealthCheck) error {
+	conn, _, err := dialProbeTunnel(addr, hc)
 	if err != nil {
-		logrus.Errorln("Error setting deadline for TLS handshake:", err)
-		return false
+		return err
 	}
+	return conn.Close()
+}
 
-	err = tlsConn.Handshake()
+// dialProbeTunnel 连接到代理并通过 CONNECT 建立到探测目标的隧道
+func dialProbeTunnel(addr string, hc HealthCheck) (net.Conn, *url.URL, error) {
+	target, u, err := probeTarget(hc)
 	if err != nil {
-		logrus.Errorln("TLS handshake with www.google.com failed:", err)
-		return false
+		return nil, nil, err
 	}
-	defer tlsConn.Close() // 确保TLS连接也被关闭
-
-	// 清除之前的超时设置，或为后续读写设置新的超时
-	err = upstreamConn.SetDeadline(time.Time{}) // 清除超时
+	// 整个探测过程共用一个超时
+	conn, err := dialUpstream(addr, hc.Timeout)
 	if err != nil {
-		logrus.Errorln("Error clearing deadline:", err)
-		return false
+		return nil, nil, fmt.Errorf("error connecting to upstream proxy: %v", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(hc.Timeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
 
-	logrus.Debug("TLS handshake successful with www.google.com. Cipher Suite:", tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+	connectReq := "CONNECT " + target + " HTTP/1.1\r\n" +
+		"Host: " + target + "\r\n" +
+		"User-Agent: curl/7.88.1\r\n" +
+		"Proxy-Connection: Keep-Alive\r\n" +
+		"\r\n"
+	logrus.Debugln("Sending CONNECT request:\n", connectReq)
+	if _, err := conn.Write([]byte(connectReq)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error sending CONNECT to upstream proxy: %v", err)
+	}
 
-	// 5. 通过TLS连接发送 HEAD 请求
-	var sb2 strings.Builder
-	sb2.WriteString("HEAD / HTTP/1.1\r\n")      // 注意是 HEAD
-	sb2.WriteString("Host: www.google.com\r\n") // 注意是 Host:
-	sb2.WriteString("User-Agent: curl/7.88.1\r\n")
-	sb2.WriteString("Accept: */*\r\n")
-	sb2.WriteString("Connection: close\r\n") // 请求后关闭连接
-	sb2.WriteString("\r\n")
-	headReq := sb2.String()
+	// 响应头用 bufferedConn 的读缓冲解析,上游紧跟在 200 之后发来的隧道数据留在这个缓冲中,
+	// 之后从 bc 读取时先返回,不会丢失
+	bc := newBufferedConn(conn)
+	resp, err := http.ReadResponse(bc.br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error parsing CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("proxy CONNECT request failed: %s", resp.Status)
+	}
+	logrus.Debug("Proxy tunnel established.")
+	return bc, u, nil
+}
 
-	logrus.Debugln("Sending HEAD request over TLS:\n", headReq)
-	_, err = tlsConn.Write([]byte(headReq))
+func probeHTTPS(addr string, hc HealthCheck) error {
+	conn, u, err := dialProbeTunnel(addr, hc)
 	if err != nil {
-		logrus.Errorln("Error sending HEAD request to www.google.com:", err)
-		return false
+		return err
+	}
+	defer conn.Close()
+
+	if u.Scheme != "http" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         u.Hostname(), // SNI (Server Name Indication)
+			InsecureSkipVerify: hc.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake with %s failed: %v", u.Hostname(), err)
+		}
+		logrus.Debug("TLS handshake successful with ", u.Hostname(), ". Cipher Suite:", tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+		conn = tlsConn
 	}
 
-	// 6. 读取来自 www.google.com 的响应 (通过TLS连接)
-	logrus.Debug("HEAD request sent. Waiting for response from www.google.com...")
-	// 使用 bufio.Reader 读取响应
-	serverResponseReader := bufio.NewReader(tlsConn)
+	path := u.RequestURI()
+	headReq := "HEAD " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"User-Agent: curl/7.88.1\r\n" +
+		"Accept: */*\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
+	logrus.Debugln("Sending HEAD request:\n", headReq)
+	if _, err := conn.Write([]byte(headReq)); err != nil {
+		return fmt.Errorf("error sending HEAD request to %s: %v", u.Host, err)
+	}
 
-	// 读取状态行
-	respStatusLine, err := serverResponseReader.ReadString('\n')
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodHead})
 	if err != nil {
-		logrus.Errorln("Error reading status line from www.google.com:", err)
-		return false
+		return fmt.Errorf("error reading response from %s: %v", u.Host, err)
 	}
-	logrus.Debug("www.google.com Status:", strings.TrimSpace(respStatusLine))
+	resp.Body.Close()
+	logrus.Debug(u.Host, " Status:", resp.Status)
 
-	// 读取并打印响应头
-	logrus.Debug("www.google.com Headers:")
-	for {
-		headerLine, err := serverResponseReader.ReadString('\n')
-		if err != nil {
-			logrus.Errorln("Error reading headers from www.google.com:", err)
-			// 对于HEAD请求，在读取完所有头部后，服务器可能会关闭连接，
-			// 这可能导致ReadString返回EOF，这不一定是错误，除非没有读取到任何头部。
-			// 如果respStatusLine成功读取，那么至少连接是成功的。
-			if strings.TrimSpace(respStatusLine) != "" {
-				break // 假定头部读取完毕，或者连接已按预期关闭
-			}
-			return false
-		}
-		logrus.Debug(headerLine)  // 打印原始头部行
-		if headerLine == "\r\n" { // HTTP头部结束
-			break
-		}
+	if hc.ExpectStatus != 0 && resp.StatusCode != hc.ExpectStatus {
+		return fmt.Errorf("unexpected status %d from %s, want %d", resp.StatusCode, u.Host, hc.ExpectStatus)
 	}
-
-	return true
+	return nil
 }
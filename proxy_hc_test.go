@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTCPStub 在本地随机端口启动一个 TCP 服务,每个连接交给 handle 处理,测试结束时关闭
+func startTCPStub(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	// 接受连接的循环本身也计入 wg,关闭时刚接受的连接不会在 Wait 之后才 Add
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// stubConnectProxy 读取 CONNECT 请求,回复 status;status 为 200 时把隧道转发到请求的目标
+func stubConnectProxy(status string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if !strings.HasPrefix(status, "200") {
+			io.WriteString(conn, "HTTP/1.1 "+status+"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		go func() {
+			io.Copy(target, br)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	httpsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer httpsTarget.Close()
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer httpTarget.Close()
+
+	proxy := startTCPStub(t, stubConnectProxy("200"))
+	denied := startTCPStub(t, stubConnectProxy("407 Proxy Authentication Required"))
+	closed := func() string {
+		ln, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := ln.Addr().String()
+		ln.Close()
+		return addr
+	}()
+
+	hc := func(kind, url string, expect int) HealthCheck {
+		return HealthCheck{Kind: kind, URL: url, Timeout: 2 * time.Second, ExpectStatus: expect, InsecureSkipVerify: true}
+	}
+	tests := []struct {
+		name   string
+		addr   string
+		hc     HealthCheck
+		wantOK bool
+	}{
+		{"tcp", proxy, hc("tcp", httpsTarget.URL, 0), true},
+		{"tcp refused", closed, hc("tcp", httpsTarget.URL, 0), false},
+		{"connect", proxy, hc("connect", httpsTarget.URL, 0), true},
+		{"connect 407", denied, hc("connect", httpsTarget.URL, 0), false},
+		{"https", proxy, hc("https", httpsTarget.URL, 204), true},
+		{"https wrong status", proxy, hc("https", httpsTarget.URL, 200), false},
+		{"http", proxy, hc("https", httpTarget.URL, 404), true},
+		{"https 407", denied, hc("https", httpsTarget.URL, 0), false},
+		{"unknown kind", proxy, hc("icmp", httpsTarget.URL, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := check_upstream_hc(tt.addr, tt.hc); got != tt.wantOK {
+				t.Errorf("check_upstream_hc = %v, want %v", got, tt.wantOK)
+			}
+		})
+	}
+}
+
+// 上游在 CONNECT 的 200 之后立即发来的数据不能丢失
+func TestProbeKeepsDataAfterConnectResponse(t *testing.T) {
+	proxy := startTCPStub(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		// 200 和隧道中的 HTTP 响应在同一次写入中发出
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"+
+			"HTTP/1.1 204 No Content\r\n\r\n")
+		io.Copy(io.Discard, br)
+	})
+	hc := HealthCheck{Kind: "https", URL: "http://probe.test/", Timeout: 2 * time.Second, ExpectStatus: 204}
+	if err := probeHTTPS(proxy, hc); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// raceEnabled 为 true 时测试使用较小的数据量,race detector 下传输数 GB 需要几分钟
+const raceEnabled = true
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 表示系统解析器的解析器名字
+const systemResolverName = "system"
+
+// hostResolver 解析直连目标的域名
+// directResolvers 中按名字保存,测试时可以替换为返回固定结果的实现
+type hostResolver interface {
+	lookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// directResolvers 配置的解析器,没有在这里的名字使用系统解析器
+var directResolvers = map[string]hostResolver{}
+
+// initResolvers 创建配置的解析器,并检查 directResolver 和规则引用的解析器都存在
+func initResolvers(cfg *Config) error {
+	resolvers := make(map[string]hostResolver)
+	for _, rc := range cfg.resolvers() {
+		if rc.Name == "" || rc.Name == systemResolverName {
+			return fmt.Errorf("invalid resolver name %q", rc.Name)
+		}
+		if _, ok := resolvers[rc.Name]; ok {
+			return fmt.Errorf("duplicate resolver %q", rc.Name)
+		}
+		r, err := newDNSResolver(rc)
+		if err != nil {
+			return fmt.Errorf("resolver %s: %v", rc.Name, err)
+		}
+		resolvers[rc.Name] = r
+	}
+
+	check := func(name string) error {
+		if _, ok := resolvers[name]; name != "" && name != systemResolverName && !ok {
+			return fmt.Errorf("unknown resolver %q", name)
+		}
+		return nil
+	}
+	if err := check(cfg.DirectResolver); err != nil {
+		return err
+	}
+	if err := check(cfg.UpstreamResolve.Resolver); err != nil {
+		return fmt.Errorf("upstreamResolve: %v", err)
+	}
+	for _, rule := range cfg.Rules {
+		if err := check(rule.Resolver); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.DomainPattern, err)
+		}
+	}
+	directResolvers = resolvers
+	return nil
+}
+
+// directResolverName 返回直连 rule 匹配的目标时使用的解析器名字
+func directResolverName(rule *Rule) string {
+	if rule != nil && rule.Resolver != "" {
+		return rule.Resolver
+	}
+	return domainForwardMap.DirectResolver
+}
+
+// lookupDirect 使用名为 resolver 的解析器解析 host,解析器不存在时使用系统解析器
+func lookupDirect(ctx context.Context, resolver, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r, ok := directResolvers[resolver]
+	if !ok {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	return r.lookupIP(ctx, host)
+}
+
+// dnsResolver 依次查询配置的 DNS 服务器,响应按 TTL 缓存
+type dnsResolver struct {
+	name       string
+	servers    []string
+	exchangers []dnsExchanger
+	cache      *dnsCache
+}
+
+func newDNSResolver(cfg ResolverConfig) (*dnsResolver, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+	r := &dnsResolver{
+		name:    cfg.Name,
+		servers: cfg.Servers,
+		cache:   newDNSCache("resolver/"+cfg.Name, cfg.CacheSize, cfg.NegativeTTL),
+	}
+	for _, server := range cfg.Servers {
+		ex, err := newDNSExchanger(server, cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("DNS server %s: %v", server, err)
+		}
+		r.exchangers = append(r.exchangers, ex)
+	}
+	return r, nil
+}
+
+// lookupIP 同时查询 A 和 AAAA,IPv4 地址在前
+// 两种记录都不存在时返回 IsNotFound 的 *net.DNSError
+func (r *dnsResolver) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := r.lookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// lookupIPTTL 和 lookupIP 相同,同时返回地址记录中最小的(剩余)TTL
+func (r *dnsResolver) lookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	results := make([]chan result, len(types))
+	for i, t := range types {
+		results[i] = make(chan result, 1)
+		go func() {
+			ips, ttl, err := r.lookup(ctx, name, t)
+			results[i] <- result{ips, ttl, err}
+		}()
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var errs []error
+	for _, ch := range results {
+		res := <-ch
+		if len(res.ips) > 0 && (len(ips) == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	if len(errs) > 0 {
+		return nil, 0, &net.DNSError{Err: errors.Join(errs...).Error(), Name: host, Server: strings.Join(r.servers, ",")}
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup 查询一种类型的记录,NXDOMAIN 和没有记录都返回空结果
+func (r *dnsResolver) lookup(ctx context.Context, name dnsmessage.Name, t dnsmessage.Type) ([]net.IP, uint32, error) {
+	id := uint16(rand.Uint32())
+	key := name.String() + "/" + t.String() + "/" + dnsmessage.ClassINET.String()
+	if resp, _, ok := r.cache.get(key, id); ok {
+		resolverQueries.WithLabelValues(r.name, t.String(), "hit").Inc()
+		return parseDNSAddrs(resp, t)
+	}
+	resolverQueries.WithLabelValues(r.name, t.String(), "miss").Inc()
+
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := r.exchange(ctx, query)
+	if err != nil {
+		resolverErrors.WithLabelValues(r.name).Inc()
+		return nil, 0, err
+	}
+	ips, ttl, err := parseDNSAddrs(resp, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.cache.put(key, "", resp)
+	return ips, ttl, nil
+}
+
+// exchange 依次尝试每个服务器直到成功
+func (r *dnsResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var errs []error
+	for i, ex := range r.exchangers {
+		resp, err := ex.exchange(ctx, query)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.servers[i], err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// parseDNSAddrs 取出响应中类型为 t 的地址记录(包括 CNAME 指向的名字的记录)和其中最小的 TTL
+func parseDNSAddrs(resp []byte, t dnsmessage.Type) ([]net.IP, uint32, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS server returned %s", msg.Header.RCode)
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, rr := range msg.Answers {
+		if rr.Header.Type != t {
+			continue
+		}
+		if len(ips) == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, ttl, nil
+}
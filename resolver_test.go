@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// exchangeFunc 用函数实现 dnsExchanger
+type exchangeFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f exchangeFunc) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// stubZone 测试用的 DNS 数据: 名字(不带结尾的点) -> 地址,所有记录使用同一个 TTL
+type stubZone struct {
+	ttl   uint32
+	addrs map[string][]string
+}
+
+// answer 按 zone 回答 query,名字不存在时回复 NXDOMAIN
+func (z stubZone) answer(t testing.TB, query []byte) []byte {
+	t.Helper()
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		t.Errorf("unpack query: %v", err)
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+	question := q.Questions[0]
+	name := question.Name.String()
+	addrs, ok := z.addrs[name[:len(name)-1]]
+	if !ok {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		hdr := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: z.ttl}
+		switch {
+		case ip.To4() != nil && question.Type == dnsmessage.TypeA:
+			hdr.Type = dnsmessage.TypeA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte(ip.To4())}})
+		case ip.To4() == nil && question.Type == dnsmessage.TypeAAAA:
+			hdr.Type = dnsmessage.TypeAAAA
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		t.Errorf("pack response: %v", err)
+	}
+	return b
+}
+
+// newStubResolver 创建使用 exchangers 查询的 dnsResolver
+func newStubResolver(name string, exchangers ...dnsExchanger) *dnsResolver {
+	r := &dnsResolver{name: name, cache: newDNSCache("resolver/"+name, 64, defaultResolver.NegativeTTL)}
+	for i, ex := range exchangers {
+		r.servers = append(r.servers, "stub"+string(rune('0'+i)))
+		r.exchangers = append(r.exchangers, ex)
+	}
+	return r
+}
+
+// withDirectResolvers 替换全局的 directResolvers,测试结束时恢复
+func withDirectResolvers(t *testing.T, resolvers map[string]hostResolver) {
+	t.Helper()
+	old := directResolvers
+	t.Cleanup(func() { directResolvers = old })
+	directResolvers = resolvers
+}
+
+// 服务器按配置的顺序尝试,第一个成功后不再查询后面的服务器
+func TestResolverFallbackOrder(t *testing.T) {
+	zone := stubZone{ttl: 60, addrs: map[string][]string{"fallback.test": {"192.0.2.7"}}}
+	var mu sync.Mutex
+	var calls []string
+	server := func(name string, fail bool) dnsExchanger {
+		return exchangeFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+			mu.Lock()
+			calls = append(calls, name)
+			mu.Unlock()
+			if fail {
+				return nil, errors.New(name + " unreachable")
+			}
+			return zone.answer(t, query), nil
+		})
+	}
+	tests := []struct {
+		name      string
+		servers   []dnsExchanger
+		wantCalls []string // 查询服务器的顺序
+		wantErr   bool
+	}{
+		{"first ok", []dnsExchanger{server("a", false), server("b", false)}, []string{"a"}, false},
+		{"second ok", []dnsExchanger{server("a", true), server("b", false), server("c", false)}, []string{"a", "b"}, false},
+		{"all fail", []dnsExchanger{server("a", true), server("b", true)}, []string{"a", "b"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			r := newStubResolver("fallback", tt.servers...)
+			_, _, err := r.lookup(context.Background(), dnsmessage.MustNewName("fallback.test."), dnsmessage.TypeA)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(tt.wantCalls) {
+				t.Fatalf("servers queried = %v, want %v", calls, tt.wantCalls)
+			}
+			if tt.wantErr {
+				// 错误中按顺序包含每个服务器的错误
+				if msg := err.Error(); !strings.Contains(msg, "stub0: a unreachable") || strings.Index(msg, "stub0") > strings.Index(msg, "stub1") {
+					t.Fatalf("err = %q, want errors from stub0 then stub1", msg)
+				}
+			}
+		})
+	}
+
+	// context 取消后不再尝试后面的服务器
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = nil
+	r := newStubResolver("fallback", exchangeFunc(func(context.Context, []byte) ([]byte, error) {
+		calls = append(calls, "a")
+		cancel()
+		return nil, context.Canceled
+	}), server("b", false))
+	if _, _, err := r.lookup(ctx, dnsmessage.MustNewName("fallback.test."), dnsmessage.TypeA); err == nil {
+		t.Fatal("lookup succeeded after the context was canceled")
+	}
+	if fmt.Sprint(calls) != "[a]" {
+		t.Fatalf("servers queried after cancel = %v, want [a]", calls)
+	}
+}
+
+// 用配置创建的解析器: 第一个服务器不可用时使用下一个真实的服务器
+func TestResolverFallbackToNextServer(t *testing.T) {
+	closed := func() string {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := pc.LocalAddr().String()
+		pc.Close()
+		return addr
+	}()
+	tcpAddr, queries := startTCPDNSStub(t, stubZone{ttl: 60, addrs: map[string][]string{"fallback.test": {"192.0.2.8"}}}, 0)
+	r, err := newDNSResolver(ResolverConfig{
+		Name:        "fallback",
+		Servers:     []string{"udp://" + closed, "tcp://" + tcpAddr},
+		Timeout:     2 * time.Second,
+		CacheSize:   16,
+		NegativeTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := r.lookupIP(context.Background(), "fallback.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0].String() != "192.0.2.8" {
+		t.Fatalf("lookupIP = %v, want [192.0.2.8]", ips)
+	}
+	// A 和 AAAA 各查询一次,之后从缓存返回
+	if _, err := r.lookupIP(context.Background(), "fallback.test"); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("tcp server queries = %d, want 2", n)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// 嗅探时数据不完整,需要读取更多数据后再试
+var errSniffIncomplete = errors.New("sniff: need more data")
+
+// 数据不是对应的协议,或者其中没有域名
+var errSniffNotFound = errors.New("sniff: no host found")
+
+// sniffTLSServerName 从 TLS ClientHello 中取出 SNI
+// b 是连接上最开始的数据,可以只包含 ClientHello 的一部分,ClientHello 也可以分成多个 TLS 记录,
+// 在找到 SNI 之前数据就结束时返回 errSniffIncomplete
+func sniffTLSServerName(b []byte) (string, error) {
+	// TLS 记录头: ContentType(1) Version(2) Length(2),类型 0x16 为握手
+	// 第一个字节就能判断不是 TLS,不需要等待更多数据
+	if !isTLSHandshakePrefix(b) {
+		return "", errSniffNotFound
+	}
+	// 拼接连续的握手记录,后面出现其他类型的记录时 ClientHello 不会再有后续数据
+	var hs []byte
+	ended := false
+	for len(b) >= 5 {
+		if !isTLSHandshakePrefix(b) {
+			ended = true
+			break
+		}
+		recordLen := int(binary.BigEndian.Uint16(b[3:5]))
+		b = b[5:]
+		if len(b) < recordLen {
+			hs, b = append(hs, b...), nil
+			break
+		}
+		hs = append(hs, b[:recordLen]...)
+		b = b[recordLen:]
+	}
+	if len(b) > 0 && !isTLSHandshakePrefix(b) {
+		ended = true
+	}
+	host, err := sniffClientHello(hs)
+	if ended && errors.Is(err, errSniffIncomplete) {
+		return "", errSniffNotFound
+	}
+	return host, err
+}
+
+// isTLSHandshakePrefix 判断 b 是否可能是一个 TLS 握手记录的开头
+func isTLSHandshakePrefix(b []byte) bool {
+	return (len(b) < 1 || b[0] == 0x16) && (len(b) < 2 || b[1] == 0x03)
+}
+
+// sniffClientHello 从握手消息中取出 SNI,hs 可以只包含握手消息的一部分
+func sniffClientHello(b []byte) (string, error) {
+	// Handshake 头: Type(1) Length(3),类型 1 为 ClientHello
+	if len(b) < 4 {
+		return "", errSniffIncomplete
+	}
+	if b[0] != 0x01 {
+		return "", errSniffNotFound
+	}
+	hsLen := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	if len(b) > hsLen {
+		b = b[:hsLen]
+	}
+
+	// ClientHello: Version(2) Random(32) SessionID CipherSuites CompressionMethods Extensions
+	p := sniffParser{b: b}
+	p.skip(2 + 32)
+	p.skip(int(p.uint8()))
+	p.skip(int(p.uint16()))
+	p.skip(int(p.uint8()))
+	extLen := int(p.uint16())
+	if p.incomplete {
+		return "", errSniffIncomplete
+	}
+	if extLen == 0 {
+		return "", errSniffNotFound
+	}
+
+	for extLen >= 4 {
+		typ := p.uint16()
+		l := int(p.uint16())
+		extLen -= 4 + l
+		if p.incomplete {
+			return "", errSniffIncomplete
+		}
+		if typ != 0x0000 { // server_name
+			p.skip(l)
+			continue
+		}
+		// ServerNameList: Length(2) { NameType(1) Length(2) HostName }
+		data := p.bytes(l)
+		if p.incomplete {
+			return "", errSniffIncomplete
+		}
+		list := sniffParser{b: data}
+		listLen := int(list.uint16())
+		for listLen >= 3 && !list.incomplete {
+			nameType := list.uint8()
+			name := list.bytes(int(list.uint16()))
+			listLen -= 3 + len(name)
+			if nameType == 0 && !list.incomplete && len(name) > 0 {
+				return strings.TrimSuffix(strings.ToLower(string(name)), "."), nil
+			}
+		}
+		return "", errSniffNotFound
+	}
+	if p.incomplete {
+		return "", errSniffIncomplete
+	}
+	return "", errSniffNotFound
+}
+
+// sniffParser 按大端序顺序读取字段,数据不够时设置 incomplete 并返回零值
+type sniffParser struct {
+	b          []byte
+	incomplete bool
+}
+
+func (p *sniffParser) bytes(n int) []byte {
+	if p.incomplete || len(p.b) < n {
+		p.incomplete = true
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *sniffParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *sniffParser) uint8() uint8 {
+	if v := p.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (p *sniffParser) uint16() uint16 {
+	if v := p.bytes(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+// sniffHTTPHost 从 HTTP/1.x 请求头中取出 Host(不包含端口)
+// 请求头还没有读完并且没有找到 Host 时返回 errSniffIncomplete
+func sniffHTTPHost(b []byte) (string, error) {
+	end := bytes.IndexByte(b, '\n')
+	if end < 0 {
+		if len(b) > 0 && !isHTTPMethodPrefix(b) {
+			return "", errSniffNotFound
+		}
+		return "", errSniffIncomplete
+	}
+	// 请求行: METHOD SP request-target SP HTTP/x.y
+	requestLine := strings.TrimRight(string(b[:end]), "\r")
+	if parts := strings.Split(requestLine, " "); len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return "", errSniffNotFound
+	}
+
+	b = b[end+1:]
+	for {
+		end = bytes.IndexByte(b, '\n')
+		if end < 0 {
+			return "", errSniffIncomplete
+		}
+		line := strings.TrimRight(string(b[:end]), "\r")
+		b = b[end+1:]
+		if line == "" {
+			// 请求头结束,没有 Host
+			return "", errSniffNotFound
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+		if host == "" {
+			return "", errSniffNotFound
+		}
+		return strings.ToLower(host), nil
+	}
+}
+
+// isHTTPMethodPrefix 判断 b 是否可能是一个 HTTP 请求方法的开头(全部为大写字母,后面可以跟空格)
+func isHTTPMethodPrefix(b []byte) bool {
+	for i, c := range b {
+		if c == ' ' && i > 0 {
+			return true
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// curlClientHello 是 curl 7.88.1 (OpenSSL 3.0) 访问 https://www.example.com 时发出的第一个 TLS 记录
+func curlClientHello(t *testing.T) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/clienthello_curl.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// goClientHello 抓取 crypto/tls 客户端发出的第一个 TLS 记录
+func goClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(hdr[3:5])))
+	copy(record, hdr)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// fragmentRecord 把一个 TLS 记录中的握手数据拆成每个最多 size 字节的多个记录
+func fragmentRecord(record []byte, size int) []byte {
+	var out []byte
+	for payload := record[5:]; len(payload) > 0; {
+		n := min(size, len(payload))
+		out = append(out, record[0], record[1], record[2], byte(n>>8), byte(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestSniffTLSServerName(t *testing.T) {
+	curl := curlClientHello(t)
+	goHello := goClientHello(t, "Go.Example.Test.")
+	noSNI := goClientHello(t, "")
+	appData := []byte{0x17, 0x03, 0x03, 0x00, 0x02, 0xaa, 0xbb}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantHost string
+		wantErr  error
+	}{
+		{"curl", curl, "www.example.com", nil},
+		{"curl with trailing data", append(append([]byte{}, curl...), appData...), "www.example.com", nil},
+		{"crypto/tls", goHello, "go.example.test", nil},
+		{"no sni", noSNI, "", errSniffNotFound},
+		{"fragmented 100", fragmentRecord(curl, 100), "www.example.com", nil},
+		{"fragmented 1", fragmentRecord(curl, 1), "www.example.com", nil},
+		{"fragmented crypto/tls", fragmentRecord(goHello, 7), "go.example.test", nil},
+		{"truncated header", curl[:3], "", errSniffIncomplete},
+		{"truncated record", curl[:60], "", errSniffIncomplete},
+		{"truncated fragments", fragmentRecord(curl, 50)[:150], "", errSniffIncomplete},
+		{"fragments interrupted", append(fragmentRecord(curl[:5+60], 30), appData...), "", errSniffNotFound},
+		{"empty", nil, "", errSniffIncomplete},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", errSniffNotFound},
+		{"non-tls first byte", []byte{'G'}, "", errSniffNotFound},
+		{"ssh banner", []byte("SSH-2.0-OpenSSH_9.2\r\n"), "", errSniffNotFound},
+		{"sslv2 record", []byte{0x80, 0x2e, 0x01, 0x00, 0x02}, "", errSniffNotFound},
+		{"wrong version byte", []byte{0x16, 0x02}, "", errSniffNotFound},
+		{"not a client hello", []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, "", errSniffNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, err := sniffTLSServerName(tt.data)
+			if host != tt.wantHost || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("sniffTLSServerName = %q, %v, want %q, %v", host, err, tt.wantHost, tt.wantErr)
+			}
+		})
+	}
+}
+
+// ClientHello 的任何前缀都不能被判定为不是 TLS,否则客户端分多次发送时会漏掉 SNI
+func TestSniffTLSServerNamePrefixes(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"curl":       curlClientHello(t),
+		"fragmented": fragmentRecord(curlClientHello(t), 64),
+	} {
+		t.Run(name, func(t *testing.T) {
+			found := false
+			for n := range len(data) + 1 {
+				host, err := sniffTLSServerName(data[:n])
+				switch {
+				case err == nil:
+					if host != "www.example.com" {
+						t.Fatalf("prefix %d: host = %q", n, host)
+					}
+					found = true
+				case found || !errors.Is(err, errSniffIncomplete):
+					t.Fatalf("prefix %d: err = %v", n, err)
+				}
+			}
+			if !found {
+				t.Fatal("SNI not found in the complete ClientHello")
+			}
+		})
+	}
+}
+
+// 客户端把 ClientHello 分成多次发送时,sniffHost 读取后续数据直到找到 SNI;
+// 不是 TLS 或者客户端不发送数据时不等待完整的 sniffTimeout
+func TestSniffHost(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   string
+	}{
+		{"split writes", splitBytes(fragmentRecord(curlClientHello(t), 200), 37), "www.example.com"},
+		{"single write", [][]byte{curlClientHello(t)}, "www.example.com"},
+		{"non-tls", [][]byte{[]byte("SSH-2.0-OpenSSH_9.2\r\n")}, ""},
+		{"no data", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				for _, c := range tt.chunks {
+					if _, err := client.Write(c); err != nil {
+						return
+					}
+				}
+			}()
+			bc := newBufferedConnSize(server, sniffBufferSize)
+			start := time.Now()
+			if got := sniffHost(bc, sniffTLSServerName); got != tt.want {
+				t.Fatalf("sniffHost = %q, want %q", got, tt.want)
+			}
+			if d := time.Since(start); d >= sniffTimeout {
+				t.Fatalf("sniffHost took %v", d)
+			}
+			if len(tt.chunks) == 0 {
+				return
+			}
+			// 嗅探读取的数据仍然保留在 bc 中
+			all := bytes.Join(tt.chunks, nil)
+			got := make([]byte, bc.br.Buffered())
+			bc.Read(got)
+			if !bytes.HasPrefix(all, got) || len(got) == 0 {
+				t.Fatalf("buffered %d bytes do not match the data sent", len(got))
+			}
+		})
+	}
+}
+
+func splitBytes(b []byte, size int) [][]byte {
+	var out [][]byte
+	for len(b) > 0 {
+		n := min(size, len(b))
+		out = append(out, b[:n])
+		b = b[n:]
+	}
+	return out
+}
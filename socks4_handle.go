@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 / SOCKS4a 协议常量
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+
+	socks4RepGranted  = 0x5a
+	socks4RepRejected = 0x5b
+
+	// USERID 和 SOCKS4a 域名的最大长度
+	socks4MaxField = 255
+)
+
+// handleSocks4Request 处理一个 SOCKS4/SOCKS4a 客户端连接
+// SOCKS4 只能携带 USERID 没有密码,配置了 SOCKS5 用户或者 proxyAuth 时拒绝 SOCKS4 连接
+func handleSocks4Request(ctx context.Context, conn net.Conn) {
+	log := requestLogger(ctx)
+	bc := newBufferedConn(conn)
+
+	// 超过连接限制的连接保留 serve 设置的较短超时
+	reject := limitRejection(ctx)
+	if reject == "" {
+		conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	}
+	cmd, host, port, err := readSocks4Request(bc.br)
+	if err != nil {
+		log.Errorf("Failed to read SOCKS4 request: %v", err)
+		conn.Close()
+		return
+	}
+	log.Debugf("SOCKS4 请求 cmd: %d target: %s", cmd, net.JoinHostPort(host, port))
+
+	// 和 SOCKS5 一样检查用户(mTLS 证书的 CN)的并发限制,release 为 nil 表示没有占用
+	var release func()
+	if reject == "" {
+		release = acquireUserLimit(ctx)
+	}
+	if release == nil {
+		writeSocks4Reply(conn, socks4RepRejected, nil)
+		conn.Close()
+		return
+	}
+	defer release()
+	conn.SetDeadline(time.Time{})
+	if len(domainForwardMap.Socks5.Users) > 0 || proxyAuth != nil {
+		log.Error("已配置认证用户,拒绝不支持密码认证的 SOCKS4 连接")
+		writeSocks4Reply(conn, socks4RepRejected, nil)
+		conn.Close()
+		return
+	}
+	if cmd != socks4CmdConnect {
+		log.Errorf("不支持的 SOCKS4 命令: %d", cmd)
+		writeSocks4Reply(conn, socks4RepRejected, nil)
+		conn.Close()
+		return
+	}
+
+	targetConn, attempt, rep := dialSocksTarget(ctx, host, port, "socks4")
+	if rep != socks5RepSuccess {
+		writeSocks4Reply(conn, socks4RepRejected, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSocks4Reply(conn, socks4RepGranted, targetConn.LocalAddr()); err != nil {
+		log.Errorln("Error writing to client:", err)
+		targetConn.Close()
+		conn.Close()
+		return
+	}
+
+	// 开始转发数据
+	forward_io_copy(ctx, bc, targetConn, attempt)
+}
+
+// readSocks4Request 读取 VN CD DSTPORT DSTIP USERID NULL,
+// DSTIP 为 0.0.0.x(x 不为 0)时是 SOCKS4a,USERID 之后还有以 NULL 结尾的域名
+func readSocks4Request(r *bufio.Reader) (cmd byte, host, port string, err error) {
+	var head [8]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[0] != socks4Version {
+		return 0, "", "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	cmd = head[1]
+	port = strconv.Itoa(int(binary.BigEndian.Uint16(head[2:4])))
+	ip := net.IP(head[4:8])
+
+	if _, err = readSocks4String(r); err != nil {
+		return 0, "", "", fmt.Errorf("error reading USERID: %v", err)
+	}
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readSocks4String(r); err != nil {
+			return 0, "", "", fmt.Errorf("error reading SOCKS4a host: %v", err)
+		}
+		return cmd, host, port, nil
+	}
+	return cmd, ip.String(), port, nil
+}
+
+// readSocks4String 读取以 NULL 结尾的字段
+func readSocks4String(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxField {
+			return "", fmt.Errorf("field too long")
+		}
+		buf = append(buf, b)
+	}
+}
+
+// writeSocks4Reply 回复 VN(0) CD DSTPORT DSTIP
+func writeSocks4Reply(conn net.Conn, rep byte, bind net.Addr) error {
+	reply := make([]byte, 8)
+	reply[1] = rep
+	if a, ok := bind.(*net.TCPAddr); ok {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(reply[2:4], uint16(a.Port))
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks4Connect 在 conn 上发送 SOCKS4 CONNECT,返回回复码
+func socks4Connect(t *testing.T, conn net.Conn, target string) byte {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	req := []byte{socks4Version, socks4CmdConnect}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	req = append(req, net.ParseIP(host).To4()...)
+	req = append(req, 0)
+	conn.Write(req)
+	return readReply(t, conn, 8)[1]
+}
+
+// SOCKS4 隧道同样占用 mTLS 证书 CN 对应用户的并发数,隧道结束后释放
+func TestSocks4UserLimit(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	withUpstreams(t, Config{})
+	limits := withConnLimits(t, Limits{MaxConnectionsPerUser: 1})
+	ctx := context.WithValue(context.Background(), clientCNKey, "bob")
+
+	var handlers []chan struct{}
+	t.Cleanup(func() {
+		for _, done := range handlers {
+			<-done
+		}
+	})
+	open := func() net.Conn {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		done := make(chan struct{})
+		handlers = append(handlers, done)
+		go func() {
+			defer close(done)
+			handleSocks4Request(ctx, server)
+		}()
+		return client
+	}
+
+	first := open()
+	if rep := socks4Connect(t, first, target); rep != socks4RepGranted {
+		t.Fatalf("first CONNECT reply = %#x, want granted", rep)
+	}
+	if rep := socks4Connect(t, open(), target); rep != socks4RepRejected {
+		t.Fatalf("second CONNECT reply = %#x, want rejected", rep)
+	}
+	if n := userConns(limits, "bob"); n != 1 {
+		t.Fatalf("user connections = %d, want 1", n)
+	}
+
+	first.Close()
+	<-handlers[0]
+	if n := userConns(limits, "bob"); n != 0 {
+		t.Fatalf("user connections after the tunnel closed = %d, want 0", n)
+	}
+	if rep := socks4Connect(t, open(), target); rep != socks4RepGranted {
+		t.Fatalf("CONNECT after release = %#x, want granted", rep)
+	}
+}
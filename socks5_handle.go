@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 协议常量 (RFC 1928 / RFC 1929)
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSuccess             = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// SOCKS 握手阶段(认证和读取请求)的超时,避免客户端连上后不发数据一直占用连接
+const socksHandshakeTimeout = 30 * time.Second
+
+// socks5Request 客户端的 SOCKS5 请求
+type socks5Request struct {
+	cmd  byte
+	host string // 域名或者不带方括号的 IP
+	port string
+}
+
+func (r socks5Request) target() string {
+	return net.JoinHostPort(r.host, r.port)
+}
+
+// handleSocks5Request 处理一个 SOCKS5 客户端连接,混合端口和 socks5 监听器共用
+// 用户名/密码在 socks5.users 或者 proxyAuth 中任意一个校验通过即可
+// 目标地址和 HTTP 代理一样经过 getForwardMethodForHost 路由,
+// proxy 方式通过上游 HTTP 代理的 CONNECT 建立隧道
+func handleSocks5Request(ctx context.Context, conn net.Conn) {
+	log := requestLogger(ctx)
+	bc := newBufferedConn(conn)
+
+	// 超过连接限制的连接保留 serve 设置的较短超时
+	reject := limitRejection(ctx)
+	if reject == "" {
+		conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	}
+	username, err := socks5Auth(bc, socks5Checker(domainForwardMap.Socks5.Users, proxyAuth))
+	if err != nil {
+		log.Errorf("SOCKS5 认证失败: %v", err)
+		conn.Close()
+		return
+	}
+	if username != "" {
+		ctx = context.WithValue(ctx, proxyUserKey, username)
+		log = requestLogger(ctx)
+	}
+	req, rep, err := readSocks5Request(bc)
+	if err != nil {
+		log.Errorf("Failed to read SOCKS5 request: %v", err)
+		if rep != socks5RepSuccess {
+			writeSocks5Reply(conn, rep, nil)
+		}
+		conn.Close()
+		return
+	}
+	// 超过连接限制时读完请求再回复拒绝,客户端能得到明确的错误
+	// 连接已经超过限制时不占用用户的并发数,release 为 nil 表示没有占用
+	var release func()
+	if reject == "" {
+		release = acquireUserLimit(ctx)
+	}
+	if release == nil {
+		writeSocks5Reply(conn, socks5RepNotAllowed, nil)
+		conn.Close()
+		return
+	}
+	defer release()
+	conn.SetDeadline(time.Time{})
+	log.Debugf("SOCKS5 请求 cmd: %d target: %s", req.cmd, req.target())
+
+	switch req.cmd {
+	case socks5CmdConnect:
+		socks5Connect(ctx, bc, req)
+	case socks5CmdUDPAssociate:
+		socks5UDPAssociate(ctx, bc)
+	default:
+		log.Errorf("不支持的 SOCKS5 命令: %d", req.cmd)
+		writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// socks5Connect 处理 CONNECT 命令
+func socks5Connect(ctx context.Context, conn net.Conn, req socks5Request) {
+	log := requestLogger(ctx)
+	targetConn, attempt, rep := dialSocksTarget(ctx, req.host, req.port, "socks5")
+	if rep != socks5RepSuccess {
+		writeSocks5Reply(conn, rep, nil)
+		conn.Close()
+		return
+	}
+
+	if err := writeSocks5Reply(conn, socks5RepSuccess, targetConn.LocalAddr()); err != nil {
+		log.Errorln("Error writing to client:", err)
+		targetConn.Close()
+		conn.Close()
+		return
+	}
+
+	// 开始转发数据
+	forward_io_copy(ctx, conn, targetConn, attempt)
+}
+
+// dialSocksTarget 对 SOCKS 请求的目标做路由并建立连接,SOCKS4 和 SOCKS5 共用
+// proxy 方式通过上游 HTTP 代理的 CONNECT 建立隧道
+// 失败时返回 SOCKS5 的错误码,由调用方转换为各自协议的回复
+func dialSocksTarget(ctx context.Context, host, port, protocol string) (net.Conn, upstreamAttempt, byte) {
+	log := requestLogger(ctx)
+	proxy_upstream := upstreams.pick()
+	upstream, ForwardMethod := getForwardMethodForHost(ctx, proxy_upstream, host, port, protocol)
+	if ForwardMethod == "block" {
+		return nil, upstreamAttempt{method: ForwardMethod}, socks5RepNotAllowed
+	}
+
+	target := net.JoinHostPort(host, port)
+	reqLine := "CONNECT " + target + " HTTP/1.1\r\n" +
+		"Host: " + target + "\r\n" +
+		"\r\n"
+	targetConn, attempt, upstream_resp, err := dialTunnel(log, buildAttempts(ctx, upstream, ForwardMethod, host, port), reqLine)
+	if err != nil {
+		log.Errorln("Error connecting to target:", err)
+		return nil, attempt, socks5ReplyForError(err)
+	}
+	if attempt.method == "proxy" {
+		if code := upstreamStatusCode(upstream_resp); code != 200 {
+			log.Errorf("上游代理拒绝了 CONNECT %s: %q", target, upstream_resp)
+			targetConn.Close()
+			return nil, attempt, socks5RepGeneralFailure
+		}
+	}
+	return targetConn, attempt, socks5RepSuccess
+}
+
+// socks5Auth 协商认证方式,check 不为 nil 时只接受用户名/密码认证,返回认证通过的用户名
+func socks5Auth(conn net.Conn, check func(username, password string) bool) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(socks5AuthNone)
+	if check != nil {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return "", err
+	}
+	if want == socks5AuthNone {
+		return "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	username, password, err := readSocks5Password(conn)
+	if err != nil {
+		return "", err
+	}
+	if !check(username, password) {
+		conn.Write([]byte{socks5PasswordVersion, 0x01})
+		return "", fmt.Errorf("invalid username or password for user %q", username)
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0x00}); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func readSocks5Password(conn net.Conn) (username, password string, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	if head[0] != socks5PasswordVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", head[0])
+	}
+	buf := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	username = string(buf)
+	var plen [1]byte
+	if _, err = io.ReadFull(conn, plen[:]); err != nil {
+		return
+	}
+	buf = make([]byte, plen[0])
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	return username, string(buf), nil
+}
+
+// socks5Checker 返回校验用户名/密码的函数,没有配置任何用户时返回 nil
+func socks5Checker(users []Socks5User, auth *proxyAuthenticator) func(username, password string) bool {
+	if len(users) == 0 && auth == nil {
+		return nil
+	}
+	return func(username, password string) bool {
+		return checkSocks5User(users, username, password) || (auth != nil && auth.check(username, password))
+	}
+}
+
+func checkSocks5User(users []Socks5User, username, password string) bool {
+	for _, u := range users {
+		if u.Username == username && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// readSocks5Request 读取 VER CMD RSV ATYP DST.ADDR DST.PORT
+// 出错时返回应该回复给客户端的错误码,socks5RepSuccess 表示直接关闭连接不回复
+func readSocks5Request(conn net.Conn) (socks5Request, byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return socks5Request{}, socks5RepSuccess, err
+	}
+	if head[0] != socks5Version {
+		return socks5Request{}, socks5RepSuccess, fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	host, port, err := readSocks5Addr(conn, head[3])
+	if err != nil {
+		if errors.Is(err, errSocks5AddrType) {
+			return socks5Request{}, socks5RepAddrTypeUnsupported, err
+		}
+		return socks5Request{}, socks5RepSuccess, err
+	}
+	return socks5Request{cmd: head[1], host: host, port: port}, socks5RepSuccess, nil
+}
+
+var errSocks5AddrType = errors.New("unsupported SOCKS5 address type")
+
+// readSocks5Addr 读取 ATYP 之后的地址和端口
+func readSocks5Addr(r io.Reader, atyp byte) (host, port string, err error) {
+	var addr []byte
+	switch atyp {
+	case socks5AtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err = io.ReadFull(r, n[:]); err != nil {
+			return
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", "", fmt.Errorf("%w: %d", errSocks5AddrType, atyp)
+	}
+	if _, err = io.ReadFull(r, addr); err != nil {
+		return
+	}
+	var p [2]byte
+	if _, err = io.ReadFull(r, p[:]); err != nil {
+		return
+	}
+	if atyp == socks5AtypDomain {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:]))), nil
+}
+
+// appendSocks5Addr 按 ATYP ADDR PORT 的格式追加地址,addr 为空时使用 0.0.0.0:0
+func appendSocks5Addr(b []byte, addr net.Addr) []byte {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSocks5Reply 回复 VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSocks5Reply(conn net.Conn, rep byte, bind net.Addr) error {
+	_, err := conn.Write(appendSocks5Addr([]byte{socks5Version, rep, 0x00}, bind))
+	return err
+}
+
+// socks5ReplyForError 把连接目标的错误转换为 SOCKS5 错误码
+func socks5ReplyForError(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5RepHostUnreachable
+	}
+	return socks5RepGeneralFailure
+}
+
+// upstreamStatusCode 取出上游代理响应头中的状态码
+func upstreamStatusCode(resp string) int {
+	// HTTP/1.1 200 Connection established
+	if len(resp) < 12 {
+		return 0
+	}
+	code, err := strconv.Atoi(resp[9:12])
+	if err != nil {
+		return 0
+	}
+	return code
+}
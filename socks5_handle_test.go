@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withProxyAuth 使用给定用户的 proxyAuth,测试结束时恢复
+// 需要在 startTestProxy 之前调用,代理的连接处理结束后才恢复
+func withProxyAuth(t *testing.T, users ...ProxyUser) {
+	t.Helper()
+	old := proxyAuth
+	t.Cleanup(func() { proxyAuth = old })
+	auth, err := newProxyAuthenticator(ProxyAuth{Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAuth = auth
+}
+
+func dialTestProxy(t *testing.T, proxy string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func readReply(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return buf
+}
+
+// socks5PasswordAuth 用用户名/密码完成 SOCKS5 认证,返回 RFC 1929 的状态
+func socks5PasswordAuth(t *testing.T, conn net.Conn, username, password string) byte {
+	t.Helper()
+	conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	if got := readReply(t, conn, 2); !bytes.Equal(got, []byte{socks5Version, socks5AuthPassword}) {
+		t.Fatalf("method selection = %v, want password", got)
+	}
+	msg := []byte{socks5PasswordVersion, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	conn.Write(msg)
+	return readReply(t, conn, 2)[1]
+}
+
+// socks5ConnectIPv4 发送 CONNECT 请求,返回回复码
+func socks5ConnectIPv4(t *testing.T, conn net.Conn, target string) byte {
+	t.Helper()
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5AtypIPv4}
+	req = append(req, net.ParseIP(host).To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	conn.Write(req)
+	return readReply(t, conn, 10)[1]
+}
+
+// 混合端口配置了 proxyAuth 时,SOCKS5 必须用 proxyAuth 的用户认证,SOCKS4 被拒绝
+func TestMixedPortSocksRequiresProxyAuth(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	withUpstreams(t, Config{})
+	withProxyAuth(t, ProxyUser{Username: "alice", Password: "secret"})
+	proxy := startTestProxy(t)
+
+	t.Run("no auth", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+		if got := readReply(t, conn, 2); !bytes.Equal(got, []byte{socks5Version, socks5AuthNoAcceptable}) {
+			t.Fatalf("method selection = %v, want no acceptable methods", got)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		if status := socks5PasswordAuth(t, conn, "alice", "wrong"); status == 0 {
+			t.Fatal("wrong password accepted")
+		}
+	})
+
+	t.Run("valid user", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		if status := socks5PasswordAuth(t, conn, "alice", "secret"); status != 0 {
+			t.Fatalf("auth status = %d, want 0", status)
+		}
+		if rep := socks5ConnectIPv4(t, conn, target); rep != socks5RepSuccess {
+			t.Fatalf("CONNECT reply = %d, want success", rep)
+		}
+		conn.Write([]byte("ping"))
+		if got := readReply(t, conn, 4); string(got) != "ping" {
+			t.Fatalf("echo = %q", got)
+		}
+	})
+
+	t.Run("socks4", func(t *testing.T) {
+		conn := dialTestProxy(t, proxy)
+		req := []byte{socks4Version, socks4CmdConnect}
+		req = binary.BigEndian.AppendUint16(req, uint16(port))
+		req = append(req, net.ParseIP(host).To4()...)
+		req = append(req, "alice\x00"...)
+		conn.Write(req)
+		if rep := readReply(t, conn, 8); rep[1] != socks4RepRejected {
+			t.Fatalf("SOCKS4 reply = %#x, want rejected", rep[1])
+		}
+	})
+}
+
+// socks5 类型的监听器同样要求 proxyAuth 的用户认证
+func TestSocks5ListenerRequiresProxyAuth(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	withUpstreams(t, Config{})
+	withProxyAuth(t, ProxyUser{Username: "alice", Password: "secret"})
+	handle, err := listenerHandler(ListenerConfig{Type: "socks5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestListener(t, ln, "", handle)
+	proxy := ln.Addr().String()
+
+	conn := dialTestProxy(t, proxy)
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	if got := readReply(t, conn, 2); !bytes.Equal(got, []byte{socks5Version, socks5AuthNoAcceptable}) {
+		t.Fatalf("method selection without credentials = %v, want no acceptable methods", got)
+	}
+
+	conn = dialTestProxy(t, proxy)
+	if status := socks5PasswordAuth(t, conn, "alice", "wrong"); status == 0 {
+		t.Fatal("wrong password accepted")
+	}
+
+	conn = dialTestProxy(t, proxy)
+	if status := socks5PasswordAuth(t, conn, "alice", "secret"); status != 0 {
+		t.Fatalf("auth status = %d, want 0", status)
+	}
+	if rep := socks5ConnectIPv4(t, conn, target); rep != socks5RepSuccess {
+		t.Fatalf("CONNECT reply = %d, want success", rep)
+	}
+}
+
+func withConnLimits(t *testing.T, cfg Limits) *connLimiter {
+	t.Helper()
+	old := connLimits
+	t.Cleanup(func() { connLimits = old })
+	connLimits = newConnLimiter(cfg)
+	return connLimits
+}
+
+func userConns(l *connLimiter, user string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perUser[user]
+}
+
+// 超过用户并发数或者连接已经超过其他限制时回复拒绝,拒绝的连接不占用用户的并发数,
+// 隧道结束后释放用户的并发数
+func TestSocks5UserLimit(t *testing.T) {
+	target := startTCPStub(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	withUpstreams(t, Config{})
+	withProxyAuth(t, ProxyUser{Username: "alice", Password: "secret"})
+	limits := withConnLimits(t, Limits{MaxConnectionsPerUser: 1})
+	proxy := startTestProxy(t)
+
+	first := dialTestProxy(t, proxy)
+	socks5PasswordAuth(t, first, "alice", "secret")
+	if rep := socks5ConnectIPv4(t, first, target); rep != socks5RepSuccess {
+		t.Fatalf("first CONNECT reply = %d, want success", rep)
+	}
+
+	second := dialTestProxy(t, proxy)
+	socks5PasswordAuth(t, second, "alice", "secret")
+	if rep := socks5ConnectIPv4(t, second, target); rep != socks5RepNotAllowed {
+		t.Fatalf("second CONNECT reply = %d, want not allowed", rep)
+	}
+
+	// 已经超过全局限制的连接
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleSocks5Request(context.WithValue(context.Background(), limitRejectKey, limitGlobal), server)
+	}()
+	socks5PasswordAuth(t, client, "alice", "secret")
+	if rep := socks5ConnectIPv4(t, client, target); rep != socks5RepNotAllowed {
+		t.Fatalf("over-limit CONNECT reply = %d, want not allowed", rep)
+	}
+	<-done
+	if n := userConns(limits, "alice"); n != 1 {
+		t.Fatalf("user connections after rejections = %d, want 1", n)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for userConns(limits, "alice") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("user slot not released after the tunnel closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := dialTestProxy(t, proxy)
+	socks5PasswordAuth(t, third, "alice", "secret")
+	if rep := socks5ConnectIPv4(t, third, target); rep != socks5RepSuccess {
+		t.Fatalf("CONNECT after release = %d, want success", rep)
+	}
+}
+
+// 超过连接限制的连接保留 serve 设置的较短超时,不会被换成握手超时
+func TestSocksRejectKeepsShortDeadline(t *testing.T) {
+	withUpstreams(t, Config{})
+	handlers := map[string]func(ctx context.Context, conn net.Conn){
+		"socks5": handleSocks5Request,
+		"socks4": handleSocks4Request,
+	}
+	for name, handle := range handlers {
+		t.Run(name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			// serve 为超限连接设置的超时,客户端一直不发送数据
+			server.SetDeadline(time.Now().Add(100 * time.Millisecond))
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handle(context.WithValue(context.Background(), limitRejectKey, limitGlobal), server)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("rejected connection outlived the limit reject deadline")
+			}
+		})
+	}
+}
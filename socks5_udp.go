@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UDP 数据报的最大长度
+const udpBufferSize = 64 * 1024
+
+// udpAssociation 一个 UDP ASSOCIATE 会话,生命周期和客户端的 TCP 控制连接绑定
+// 客户端发来的数据报按目标地址路由,每个目标在 NAT 表中有一个表项:
+// direct 使用单独的本地 UDP socket,proxy 共用一个到 SOCKS5 上游的 UDP 会话,block 直接丢弃
+type udpAssociation struct {
+	ctx      context.Context
+	log      *logrus.Entry
+	cfg      Socks5UDP
+	relay    *net.UDPConn // 与客户端通信的 UDP socket
+	clientIP net.IP       // 只接受来自 TCP 控制连接同一 IP 的数据报
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr // 最近一次收到数据报的客户端地址,回复发往这里
+	nat        map[string]*udpNATEntry
+	upstream   *udpUpstream
+	closed     bool
+}
+
+// 表项就绪前每个目标最多排队的数据报数,超过的丢弃
+const udpPendingPackets = 16
+
+// udpNATEntry 一个目标地址的路由结果和 direct 方式的本地 socket
+// ready 之前 method、conn 和 upstream 还没有确定,ready 和 pending 由 udpAssociation.mu 保护
+type udpNATEntry struct {
+	target     string
+	method     string
+	conn       *net.UDPConn // 只有 direct 方式使用
+	upstream   *udpUpstream // 只有 proxy 方式使用
+	lastActive atomic.Int64
+	ready      bool
+	pending    []udpPacket // 就绪前收到的数据报
+}
+
+// udpPacket 排队的客户端数据报,payload 是 data 中去掉 SOCKS5 UDP 头的部分
+type udpPacket struct {
+	data    []byte
+	payload []byte
+}
+
+func (e *udpNATEntry) touch() {
+	e.lastActive.Store(time.Now().UnixNano())
+}
+
+func (e *udpNATEntry) idle(now time.Time, timeout time.Duration) bool {
+	return now.Sub(time.Unix(0, e.lastActive.Load())) > timeout
+}
+
+// socks5UDPAssociate 处理 UDP ASSOCIATE 命令
+func socks5UDPAssociate(ctx context.Context, conn net.Conn) {
+	log := requestLogger(ctx)
+	cfg := domainForwardMap.socks5UDP()
+	if cfg.Disable {
+		log.Error("SOCKS5 UDP 转发未启用")
+		writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+		conn.Close()
+		return
+	}
+
+	// 在接受 TCP 连接的同一个地址上监听 UDP,客户端才能访问到
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	clientAddr, clientOK := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !clientOK {
+		log.Errorf("UDP ASSOCIATE 只支持 TCP 监听器, 当前为 %s", conn.LocalAddr().Network())
+		writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+		conn.Close()
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		log.Errorln("Error listening UDP:", err)
+		writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		conn.Close()
+		return
+	}
+	if err := writeSocks5Reply(conn, socks5RepSuccess, relay.LocalAddr()); err != nil {
+		log.Errorln("Error writing to client:", err)
+		relay.Close()
+		conn.Close()
+		return
+	}
+	log.Infof("SOCKS5 UDP 会话开始 client: %s relay: %s", conn.RemoteAddr(), relay.LocalAddr())
+
+	a := &udpAssociation{
+		ctx:      ctx,
+		log:      log,
+		cfg:      cfg,
+		relay:    relay,
+		clientIP: clientAddr.IP,
+		nat:      make(map[string]*udpNATEntry),
+	}
+	go a.serve()
+	go a.expire()
+
+	// TCP 控制连接关闭时结束整个 UDP 会话
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	a.close()
+	log.Infof("SOCKS5 UDP 会话结束 client: %s", conn.RemoteAddr())
+}
+
+// serve 读取客户端发来的数据报并转发
+func (a *udpAssociation) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			udpDroppedPackets.WithLabelValues("foreign_source").Inc()
+			continue
+		}
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+
+		host, port, payload, err := parseSocks5UDP(buf[:n])
+		if err != nil {
+			a.log.Debugf("丢弃无效的 SOCKS5 UDP 数据报: %v", err)
+			udpDroppedPackets.WithLabelValues("invalid").Inc()
+			continue
+		}
+		e := a.entry(host, port, buf[:n], len(payload))
+		if e == nil {
+			continue
+		}
+		e.touch()
+		a.forward(e, buf[:n], payload)
+	}
+}
+
+// forward 按表项的转发方式发送客户端的数据报,packet 是带有 SOCKS5 UDP 头的完整数据报
+func (a *udpAssociation) forward(e *udpNATEntry, packet, payload []byte) {
+	var err error
+	switch e.method {
+	case "direct":
+		_, err = e.conn.Write(payload)
+	case "proxy":
+		// 上游也是 SOCKS5,数据报连同 SOCKS5 UDP 头原样转发
+		err = e.upstream.send(packet)
+	default:
+		udpDroppedPackets.WithLabelValues("block").Inc()
+		return
+	}
+	if err != nil {
+		a.log.Debugf("UDP 转发到 %s 失败: %v", e.target, err)
+		udpDroppedPackets.WithLabelValues("send_error").Inc()
+		return
+	}
+	udpUploadBytes.WithLabelValues(e.method).Add(float64(len(payload)))
+}
+
+// entry 返回目标地址对应的已经就绪的 NAT 表项,由调用方转发数据报
+// 表项不存在时插入一个等待中的表项,在单独的 goroutine 中路由和建立连接,
+// 解析和连接很慢时也不阻塞读取其他目标的数据报;表项就绪前的数据报复制到表项的队列中,
+// 就绪后按顺序发出。这两种情况都返回 nil
+func (a *udpAssociation) entry(host, port string, packet []byte, payloadLen int) *udpNATEntry {
+	target := net.JoinHostPort(host, port)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	e, ok := a.nat[target]
+	if ok && e.ready {
+		return e
+	}
+	if !ok {
+		e = &udpNATEntry{target: target}
+		a.nat[target] = e
+		go a.setup(e, host, port)
+	}
+	if len(e.pending) >= udpPendingPackets {
+		udpDroppedPackets.WithLabelValues("pending_full").Inc()
+		return nil
+	}
+	data := bytes.Clone(packet)
+	e.pending = append(e.pending, udpPacket{data: data, payload: data[len(data)-payloadLen:]})
+	return nil
+}
+
+// setup 为等待中的表项按规则路由并建立连接,成功后表项就绪并发出排队的数据报,
+// 失败时删除表项并丢弃排队的数据报
+func (a *udpAssociation) setup(e *udpNATEntry, host, port string) {
+	for {
+		a.mu.Lock()
+		needUpstream := a.upstream == nil
+		a.mu.Unlock()
+
+		// 解析和建立连接可能很慢,在锁外进行,不阻塞其他目标的回复和过期清理
+		created, up, reason := a.newEntry(host, port, needUpstream)
+
+		a.mu.Lock()
+		if a.closed {
+			a.mu.Unlock()
+			if reason == "" {
+				created.discard(up)
+			}
+			return
+		}
+		if reason != "" {
+			udpDroppedPackets.WithLabelValues(reason).Add(float64(len(e.pending)))
+			if a.nat[e.target] == e {
+				delete(a.nat, e.target)
+			}
+			a.mu.Unlock()
+			return
+		}
+		if created.method == "proxy" {
+			switch {
+			case a.upstream != nil:
+				if up != nil {
+					up.close()
+				}
+			case up != nil:
+				a.upstream = up
+				go a.readUpstream(up)
+			default:
+				// 上游会话在锁外期间被关闭,重新建立
+				a.mu.Unlock()
+				continue
+			}
+			e.upstream = a.upstream
+		}
+		e.method, e.conn = created.method, created.conn
+		if e.conn != nil {
+			go a.readDirect(e)
+		}
+		e.touch()
+		e.ready = true
+		udpNATEntries.Inc()
+		// 持有锁发出排队的数据报,之后到达的数据报不会排到它们前面
+		for _, p := range e.pending {
+			a.forward(e, p.data, p.payload)
+		}
+		e.pending = nil
+		a.mu.Unlock()
+		return
+	}
+}
+
+// newEntry 按规则路由目标并建立 direct 方式的本地 socket,needUpstream 为 true 时为 proxy 方式建立到上游的会话
+// 不持有 a.mu,失败时返回丢弃数据报的原因
+func (a *udpAssociation) newEntry(host, port string, needUpstream bool) (*udpNATEntry, *udpUpstream, string) {
+	target := net.JoinHostPort(host, port)
+	_, method := getForwardMethodForHost(a.ctx, a.cfg.Upstream, host, port, "udp")
+	e := &udpNATEntry{target: target, method: method}
+	switch method {
+	case "direct":
+		raddr, err := a.resolveDirect(host, port)
+		if err != nil {
+			a.log.Errorf("UDP 目标 %s 解析失败: %v", target, err)
+			return nil, nil, "resolve_error"
+		}
+		conn, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			a.log.Errorf("UDP 目标 %s 连接失败: %v", target, err)
+			return nil, nil, "send_error"
+		}
+		e.conn = conn
+	case "proxy":
+		if !needUpstream {
+			return e, nil, ""
+		}
+		if a.cfg.Upstream == "" {
+			a.log.Warnf("未配置 SOCKS5 UDP 上游,丢弃发往 %s 的数据报", target)
+			return nil, nil, "no_upstream"
+		}
+		up, err := dialUDPUpstream(a.cfg)
+		if err != nil {
+			a.log.Errorf("SOCKS5 UDP 上游 %s 连接失败: %v", a.cfg.Upstream, err)
+			return nil, nil, "send_error"
+		}
+		return e, up, ""
+	}
+	return e, nil, ""
+}
+
+// discard 关闭没有放入 NAT 表的表项的 socket 和为它建立的上游会话
+func (e *udpNATEntry) discard(up *udpUpstream) {
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	if up != nil {
+		up.close()
+	}
+}
+
+// resolveDirect 使用规则选择的解析器解析直连的目标,按 upstreamResolve.prefer 选择地址族
+func (a *udpAssociation) resolveDirect(host, port string) (*net.UDPAddr, error) {
+	resolver := directResolverName(matchRule(a.ctx, host))
+	if _, ok := directResolvers[resolver]; !ok {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, domainForwardMap.retry().Timeout)
+	defer cancel()
+	ips, err := lookupDirect(ctx, resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = sortIPsByPreference(ips, domainForwardMap.upstreamResolve().Prefer)
+	return &net.UDPAddr{IP: ips[0], Port: p}, nil
+}
+
+// readDirect 把直连目标的回复加上 SOCKS5 UDP 头发回客户端
+func (a *udpAssociation) readDirect(e *udpNATEntry) {
+	buf := make([]byte, udpBufferSize)
+	from := e.conn.RemoteAddr()
+	for {
+		n, err := e.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		e.touch()
+		packet := append(appendSocks5Addr([]byte{0, 0, 0}, from), buf[:n]...)
+		if a.reply(packet) {
+			udpDownloadBytes.WithLabelValues("direct").Add(float64(n))
+		}
+	}
+}
+
+// readUpstream 把 SOCKS5 上游的回复(已经带有 SOCKS5 UDP 头)原样发回客户端
+func (a *udpAssociation) readUpstream(up *udpUpstream) {
+	defer func() {
+		// 上游会话结束,删除使用它的表项,后续数据报重新建立会话
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for target, e := range a.nat {
+			if e.upstream == up {
+				a.removeLocked(target, e)
+			}
+		}
+		if a.upstream == up {
+			a.upstream = nil
+		}
+	}()
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := up.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		host, port, payload, err := parseSocks5UDP(buf[:n])
+		if err != nil {
+			udpDroppedPackets.WithLabelValues("invalid").Inc()
+			continue
+		}
+		a.mu.Lock()
+		e := a.nat[net.JoinHostPort(host, port)]
+		a.mu.Unlock()
+		if e != nil {
+			e.touch()
+		}
+		if a.reply(buf[:n]) {
+			udpDownloadBytes.WithLabelValues("proxy").Add(float64(len(payload)))
+		}
+	}
+}
+
+// reply 发送数据报给客户端
+func (a *udpAssociation) reply(packet []byte) bool {
+	a.mu.Lock()
+	to := a.clientAddr
+	a.mu.Unlock()
+	if _, err := a.relay.WriteToUDP(packet, to); err != nil {
+		a.log.Debugf("UDP 回复客户端 %s 失败: %v", to, err)
+		udpDroppedPackets.WithLabelValues("send_error").Inc()
+		return false
+	}
+	return true
+}
+
+// expire 定期删除空闲的 NAT 表项,所有 proxy 表项都过期后关闭到上游的会话
+func (a *udpAssociation) expire() {
+	ticker := time.NewTicker(a.cfg.IdleTimeout / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.mu.Lock()
+		if a.closed {
+			a.mu.Unlock()
+			return
+		}
+		proxyInUse := false
+		for target, e := range a.nat {
+			// 等待中的表项由 setup 处理
+			if !e.ready {
+				continue
+			}
+			if !e.idle(now, a.cfg.IdleTimeout) {
+				proxyInUse = proxyInUse || e.method == "proxy"
+				continue
+			}
+			a.log.Debugf("UDP NAT 表项 %s 空闲超时", target)
+			a.removeLocked(target, e)
+		}
+		if !proxyInUse && a.upstream != nil {
+			a.upstream.close()
+			a.upstream = nil
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *udpAssociation) removeLocked(target string, e *udpNATEntry) {
+	if e.conn != nil {
+		e.conn.Close()
+	}
+	delete(a.nat, target)
+	if e.ready {
+		udpNATEntries.Dec()
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.relay.Close()
+	for target, e := range a.nat {
+		a.removeLocked(target, e)
+	}
+	if a.upstream != nil {
+		a.upstream.close()
+		a.upstream = nil
+	}
+}
+
+// parseSocks5UDP 解析 RSV(2) FRAG ATYP DST.ADDR DST.PORT DATA
+// 不支持分片,FRAG 不为 0 的数据报视为无效
+func parseSocks5UDP(b []byte) (host, port string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", "", nil, fmt.Errorf("datagram too short")
+	}
+	if b[2] != 0 {
+		return "", "", nil, fmt.Errorf("fragmented datagram not supported")
+	}
+	r := bytes.NewReader(b[4:])
+	host, port, err = readSocks5Addr(r, b[3])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
+
+// udpUpstream 到 SOCKS5 上游的 UDP ASSOCIATE 会话
+type udpUpstream struct {
+	ctrl net.Conn     // TCP 控制连接,关闭后上游结束会话
+	conn *net.UDPConn // 发往上游 UDP 中继地址
+}
+
+// dialUDPUpstream 连接 SOCKS5 上游并建立 UDP ASSOCIATE 会话
+func dialUDPUpstream(cfg Socks5UDP) (*udpUpstream, error) {
+	timeout := domainForwardMap.retry().Timeout
+	ctrl, err := net.DialTimeout("tcp", cfg.Upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(timeout))
+	bindHost, bindPort, err := socks5ClientHandshake(ctrl, cfg.Username, cfg.Password, socks5CmdUDPAssociate)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// 上游返回的中继地址是 0.0.0.0 时使用控制连接的地址
+	if ip := net.ParseIP(bindHost); ip == nil || ip.IsUnspecified() {
+		bindHost = ctrl.RemoteAddr().(*net.TCPAddr).IP.String()
+	}
+	raddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bindHost, bindPort))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	up := &udpUpstream{ctrl: ctrl, conn: conn}
+	// 上游关闭控制连接时会话已经失效
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		up.close()
+	}()
+	return up, nil
+}
+
+func (u *udpUpstream) send(packet []byte) error {
+	_, err := u.conn.Write(packet)
+	return err
+}
+
+func (u *udpUpstream) close() {
+	u.ctrl.Close()
+	u.conn.Close()
+}
+
+// socks5ClientHandshake 作为客户端与 SOCKS5 服务器完成认证并发送请求,目标地址为 0.0.0.0:0
+// 返回服务器回复的 BND.ADDR 和 BND.PORT
+func socks5ClientHandshake(conn net.Conn, username, password string, cmd byte) (host, port string, err error) {
+	method := byte(socks5AuthNone)
+	if username != "" {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return
+	}
+	var resp [2]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return
+	}
+	if resp[0] != socks5Version || resp[1] != method {
+		return "", "", fmt.Errorf("upstream rejected auth method %d", method)
+	}
+	if method == socks5AuthPassword {
+		auth := []byte{socks5PasswordVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, resp[:]); err != nil {
+			return
+		}
+		if resp[1] != 0x00 {
+			return "", "", fmt.Errorf("upstream rejected username or password")
+		}
+	}
+
+	if _, err = conn.Write(appendSocks5Addr([]byte{socks5Version, cmd, 0x00}, nil)); err != nil {
+		return
+	}
+	var head [4]byte
+	if _, err = io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	if head[1] != socks5RepSuccess {
+		return "", "", fmt.Errorf("upstream replied %d", head[1])
+	}
+	return readSocks5Addr(conn, head[3])
+}
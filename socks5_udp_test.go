@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks5UDPDomain 构造发往域名目标的 SOCKS5 UDP 数据报
+func socks5UDPDomain(host string, port int, payload string) []byte {
+	b := []byte{0, 0, 0, socks5AtypDomain, byte(len(host))}
+	b = append(b, host...)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	return append(b, payload...)
+}
+
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// 新目标的解析很慢时不阻塞会话读取其他目标的数据报,
+// 解析期间发往新目标的数据报排队,就绪后按顺序发出,同一个目标只有一个表项
+func TestUDPSlowResolveDoesNotBlockOtherTargets(t *testing.T) {
+	zone := stubZone{ttl: 60, addrs: map[string][]string{"slow.test": {"127.0.0.1"}}}
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	slow := newStubResolver("slow", exchangeFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return zone.answer(t, query), nil
+	}))
+	withDirectResolvers(t, map[string]hostResolver{"slow": slow})
+	withUpstreams(t, Config{Rules: []Rule{{DomainPattern: "slow.test", ForwardMethod: "direct", Resolver: "slow"}}})
+
+	// fast 回显收到的数据,slow 是域名解析很慢的目标
+	fast := listenTestUDP(t)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := fast.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			fast.WriteToUDP(buf[:n], from)
+		}
+	}()
+	slowTarget := listenTestUDP(t)
+	slowPort := slowTarget.LocalAddr().(*net.UDPAddr).Port
+
+	relay := listenTestUDP(t)
+	relay.SetDeadline(time.Time{})
+	a := &udpAssociation{
+		ctx:      context.Background(),
+		log:      discardLog(),
+		cfg:      domainForwardMap.socks5UDP(),
+		relay:    relay,
+		clientIP: net.IPv4(127, 0, 0, 1),
+		nat:      make(map[string]*udpNATEntry),
+	}
+	defer a.close()
+	go a.serve()
+
+	client := listenTestUDP(t)
+	send := func(packet []byte) {
+		t.Helper()
+		if _, err := client.WriteToUDP(packet, relay.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(socks5UDPDomain("slow.test", slowPort, "queued-1"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver was not called")
+	}
+	send(socks5UDPDomain("slow.test", slowPort, "queued-2"))
+	send(append(appendSocks5Addr([]byte{0, 0, 0}, fast.LocalAddr()), "ping"...))
+
+	// 解析还没有结束,已有目标的回复照常到达
+	buf := make([]byte, udpBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("reply from the fast target while resolving: %v", err)
+	}
+	_, _, payload, err := parseSocks5UDP(buf[:n])
+	if err != nil || string(payload) != "ping" {
+		t.Fatalf("reply = %q, err = %v, want ping", payload, err)
+	}
+
+	close(release)
+	for _, want := range []string{"queued-1", "queued-2"} {
+		n, err := slowTarget.Read(buf)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", want, err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("slow target received %q, want %q", got, want)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.nat) != 2 {
+		t.Fatalf("NAT entries = %d, want 2", len(a.nat))
+	}
+	e := a.nat[net.JoinHostPort("slow.test", strconv.Itoa(slowPort))]
+	if e == nil || !e.ready || len(e.pending) != 0 {
+		t.Fatalf("slow target entry = %+v, want ready with no pending datagrams", e)
+	}
+}
+
+// 表项建立失败时从 NAT 表中删除,之后的数据报重新创建表项
+func TestUDPFailedSetupRemovesEntry(t *testing.T) {
+	withUpstreams(t, Config{Rules: []Rule{{DomainPattern: "gone.test", ForwardMethod: "proxy"}}})
+	relay := listenTestUDP(t)
+	a := &udpAssociation{
+		ctx:   context.Background(),
+		log:   discardLog(),
+		cfg:   domainForwardMap.socks5UDP(),
+		relay: relay,
+		nat:   make(map[string]*udpNATEntry),
+	}
+	defer a.close()
+
+	// 没有配置 SOCKS5 UDP 上游,proxy 方式的表项无法建立
+	packet := socks5UDPDomain("gone.test", 53, "query")
+	if e := a.entry("gone.test", "53", packet, len("query")); e != nil {
+		t.Fatal("a new entry was returned before setup finished")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		n := len(a.nat)
+		a.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed entry was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
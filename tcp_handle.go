@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"net/http"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,21 +23,23 @@ func logConnectionType(log *logrus.Entry, upstreamHost string, conn net.Conn) {
 	}
 }
 
-func readRequestHeaderAndBody(conn net.Conn) (string, []byte, error) {
-	reader := bufio.NewReader(conn)
+// readRequestHead 从 reader 中读取一个请求的请求行和请求头,请求体留在 reader 中由调用方流式读取
+// 同一个客户端连接上的多个请求共用一个 reader,连接上没有更多请求时返回 io.EOF
+func readRequestHead(reader *bufio.Reader) (string, error) {
 	var requestBuilder strings.Builder
-	var contentLength int64 = 0
 
 	for {
 		line, err := reader.ReadString('\n')
+		if err == io.EOF && requestBuilder.Len() == 0 && line == "" {
+			return "", io.EOF
+		}
 		if err != nil && err != io.EOF {
-			return "", nil, fmt.Errorf("error reading client request: %v", err)
+			return "", fmt.Errorf("error reading client request: %w", err)
 		}
 
 		requestBuilder.WriteString(line)
-
-		if strings.HasPrefix(line, "Content-Length:") {
-			contentLength, _ = strconv.ParseInt(strings.TrimSpace(strings.Split(line, ":")[1]), 10, 64)
+		if requestBuilder.Len() > http.DefaultMaxHeaderBytes {
+			return "", fmt.Errorf("request header too large")
 		}
 
 		if err == io.EOF || line == "\r\n" {
@@ -45,21 +47,12 @@ func readRequestHeaderAndBody(conn net.Conn) (string, []byte, error) {
 		}
 	}
 
-	var body []byte
-	if contentLength > 0 {
-		body = make([]byte, contentLength)
-		_, err := io.ReadFull(reader, body)
-		if err != nil {
-			return "", nil, fmt.Errorf("error reading request body: %v", err)
-		}
-	}
-
-	return requestBuilder.String(), body, nil
+	return requestBuilder.String(), nil
 }
 
 // 处理CONNECT请求（HTTPS代理）
 func handleConnectRequest_https(ctx context.Context, conn net.Conn, target, reqLine string) {
-	log := logrus.WithField("reqID", ctx.Value(requestIDKey))
+	log := requestLogger(ctx)
 	hostPort := strings.Split(target, ":")
 	if len(hostPort) != 2 {
 		// ipv6 地址可能包含多个冒号，需要特殊处理 // [2408:8706:0:680b::35]:443
@@ -78,83 +71,134 @@ func handleConnectRequest_https(ctx context.Context, conn net.Conn, target, reqL
 	host := hostPort[0]
 	port := hostPort[1]
 	log.Debug("handleConnectRequest_https target:", target, " host:", host, " port:", port)
-	proxy_upstream := *proxyAddr
-	upstream, ForwardMethod := getForwardMethodForHost(log, proxy_upstream, host, port, "https")
+	if sniff := domainForwardMap.ConnectSniff; sniff.Enable && strings.HasPrefix(reqLine, "CONNECT ") &&
+		(!sniff.OnlyIP || net.ParseIP(strings.Trim(host, "[]")) != nil) {
+		forwardSniffed(ctx, conn, host, port, reqLine)
+		return
+	}
+	proxy_upstream := upstreams.pick()
+	upstream, ForwardMethod := getForwardMethodForHost(ctx, proxy_upstream, host, port, "https")
 
 	// 调用 forward 函数进行请求转发
-	forward(ctx, upstream, ForwardMethod, reqLine, conn)
+	forward(ctx, buildAttempts(ctx, upstream, ForwardMethod, host, port), reqLine, conn)
 
 }
-func forward(ctx context.Context, upstreamHost, forward_method, reqLine string, conn net.Conn) {
-	log := logrus.WithField("reqID", ctx.Value(requestIDKey))
-	switch forward_method {
-	case "proxy":
-		upstreamConn, err := net.Dial("tcp", upstreamHost)
-		if err != nil {
-			log.Errorln("Error connecting to target:", err)
-			conn.Close() // 关闭客户端连接
-			return
-		}
+func forward(ctx context.Context, attempts []upstreamAttempt, reqLine string, conn net.Conn) {
+	log := requestLogger(ctx)
+	if attempts[0].method == "block" {
+		//让客户端连接直接关闭
+		conn.Close()
+		return
+	}
 
+	targetConn, attempt, upstream_resp, err := dialTunnel(log, attempts, reqLine)
+	if err != nil {
+		log.Errorln("Error connecting to target:", err)
+		conn.Close() // 关闭客户端连接
+		return
+	}
+
+	if attempt.method == "proxy" {
+		// 转发上游代理的响应给客户端
+		_, err = conn.Write([]byte(upstream_resp))
+	} else {
+		// 告诉客户端隧道已建立
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}
+	if err != nil {
+		log.Errorln("Error writing to client:", err)
+		targetConn.Close() // 关闭目标连接
+		conn.Close()       // 关闭客户端连接
+		return
+	}
+
+	// 开始转发数据
+	forward_io_copy(ctx, conn, targetConn, attempt)
+}
+
+// dialTunnel 按顺序尝试 attempts 建立到目标的隧道
+// proxy 方式会把 reqLine(CONNECT 请求)发给上游代理,并返回上游代理的响应头
+func dialTunnel(log *logrus.Entry, attempts []upstreamAttempt, reqLine string) (net.Conn, upstreamAttempt, string, error) {
+	// 对于CONNECT隧道，每个请求都必须是一个新的TCP连接，
+	// 因为隧道的生命周期与客户端的单个会话绑定。
+	// 在这里使用连接池没有意义，因为连接在会话结束后无法被安全地复用。
+	// 在向客户端写入任何数据之前，连接失败可以安全地换下一个上游重试
+	var upstream_resp string
+	targetConn, attempt, err := dialAttempts(log, attempts, func(c *bufferedConn, a upstreamAttempt) error {
+		if a.method != "proxy" {
+			return nil
+		}
 		// 将客户端的 CONNECT 请求转发给上游代理
-		_, err = upstreamConn.Write([]byte(reqLine))
-		if err != nil {
-			log.Errorln("Error forwarding CONNECT to upstream:", err)
-			upstreamConn.Close() // 关闭上游连接
-			conn.Close()         // 关闭客户端连接
-			return
+		if _, err := c.Write([]byte(reqLine)); err != nil {
+			return fmt.Errorf("error forwarding CONNECT to upstream: %v", err)
 		}
-
 		// 读取上游代理的响应
-		upstream_resp, err := readRequestHeader(upstreamConn)
+		resp, err := readRequestHeader(c.br)
 		if err != nil {
-			log.Errorln("readRequestHeader(upstreamConn) error ", err)
-			upstreamConn.Close() // 关闭上游连接
-			conn.Close()         // 关闭客户端连接
-			return
+			return err
 		}
-
-		// 转发上游代理的响应给客户端
-		_, err = conn.Write([]byte(upstream_resp))
-		if err != nil {
-			log.Errorln("Error forwarding response to client:", err)
-			upstreamConn.Close() // 关闭上游连接
-			conn.Close()         // 关闭客户端连接
-			return
+		if !strings.HasPrefix(resp, "HTTP/") {
+			return fmt.Errorf("invalid CONNECT response from upstream: %q", resp)
 		}
-		forward_io_copy(ctx, conn, upstreamConn, forward_method)
-	case "direct":
-		// 对于CONNECT隧道，每个请求都必须是一个新的TCP连接，
-		// 因为隧道的生命周期与客户端的单个会话绑定。
-		// 在这里使用连接池没有意义，因为连接在会话结束后无法被安全地复用。
-		targetConn, err := net.Dial("tcp", upstreamHost)
-		if err != nil {
-			log.Errorf("Error connecting to target %s: %v", upstreamHost, err)
-			conn.Close() // 关闭客户端连接
-			return
+		upstream_resp = resp
+		if code := upstreamStatusCode(resp); code < 200 || code >= 300 {
+			return &upstreamStatusError{status: code}
 		}
-		logConnectionType(log, upstreamHost, targetConn)
+		return nil
+	})
+	return targetConn, attempt, upstream_resp, err
+}
 
-		// 告诉客户端隧道已建立
-		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-		if err != nil {
-			log.Errorln("Error writing to client:", err)
-			targetConn.Close() // 关闭目标连接
-			conn.Close()       // 关闭客户端连接
-			return
-		}
+// forwardSniffed 先告诉客户端隧道已建立,再根据 ClientHello 中的 SNI 路由
+// 隧道的目标不变,SNI 只用来决定直连、代理还是拦截;没有 SNI 时按 CONNECT 的 host 路由
+// 已经回复了 200,连接上游失败时只能关闭客户端连接。
+// 客户端没有很快发送数据时(服务器先发送数据的协议)不等待 SNI,立即按 CONNECT 的 host 连接
+func forwardSniffed(ctx context.Context, conn net.Conn, host, port, reqLine string) {
+	log := requestLogger(ctx)
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Errorln("Error writing to client:", err)
+		conn.Close()
+		return
+	}
 
-		// 开始转发数据
-		forward_io_copy(ctx, conn, targetConn, forward_method)
-	case "block":
-		//让客户端连接直接关闭
+	// 连接原有的读缓冲可能放不下完整的 ClientHello,在外面再包一层更大的读缓冲,
+	// 原有缓冲中的数据会先被读出,不会丢失
+	bc := &bufferedConn{Conn: conn, br: bufio.NewReaderSize(conn, sniffBufferSize)}
+	routeHost := host
+	if sni := sniffHost(bc, sniffTLSServerName); sni != "" {
+		log.Debugf("CONNECT %s 嗅探到 SNI: %s", host, sni)
+		routeHost = sni
+	}
+
+	proxy_upstream := upstreams.pick()
+	upstream, ForwardMethod := getForwardMethodForHost(ctx, proxy_upstream, routeHost, port, "https")
+	if ForwardMethod == "block" {
+		conn.Close()
+		return
+	}
+	attempts := withDirectAddr(buildAttempts(ctx, upstream, ForwardMethod, routeHost, port), joinHostPort(host, port))
+	targetConn, attempt, upstream_resp, err := dialTunnel(log, attempts, reqLine)
+	if err != nil {
+		log.Errorln("Error connecting to target:", err)
+		conn.Close()
+		return
+	}
+	if attempt.method == "proxy" && upstreamStatusCode(upstream_resp) != 200 {
+		log.Errorf("上游代理拒绝了 CONNECT %s:%s: %q", host, port, upstream_resp)
+		targetConn.Close()
 		conn.Close()
+		return
 	}
 
+	// 开始转发数据
+	forward_io_copy(ctx, bc, targetConn, attempt)
 }
 
-func forward_io_copy(ctx context.Context, conn, targetConn net.Conn, forward_method string) {
-	log := logrus.WithField("reqID", ctx.Value(requestIDKey))
+// forward_io_copy 在客户端连接和目标连接之间双向转发数据,按 attempt 的路由结果限速
+func forward_io_copy(ctx context.Context, conn, targetConn net.Conn, attempt upstreamAttempt) {
+	log := requestLogger(ctx)
+	forward_method := attempt.method
+	conn = shapeConn(conn, attempt)
 	defer func() {
 		err := conn.Close()
 		if err != nil {
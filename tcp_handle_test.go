@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 开启 SNI 嗅探时,服务器先发送数据的协议不需要等待完整的嗅探超时
+func TestConnectSniffServerFirst(t *testing.T) {
+	const banner = "SSH-2.0-stub\r\n"
+	target := startTCPStub(t, func(conn net.Conn) {
+		io.WriteString(conn, banner)
+		io.Copy(io.Discard, conn)
+	})
+	withUpstreams(t, Config{ConnectSniff: ConnectSniff{Enable: true}})
+	proxy := startTestProxy(t)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %s", resp.Status)
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != banner {
+		t.Fatalf("banner = %q, want %q", strings.TrimSpace(line), strings.TrimSpace(banner))
+	}
+	if d := time.Since(start); d >= sniffTimeout {
+		t.Fatalf("banner arrived after %v, want less than the sniff timeout %v", d, sniffTimeout)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 客户端完成 TLS 握手的超时
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newInboundTLSConfig 根据配置生成 TLS 入站使用的 tls.Config
+func newInboundTLSConfig(cfg TLSInbound) (*tls.Config, error) {
+	cert, err := loadOrCreateCert(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pemData, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// loadOrCreateCert 加载证书和私钥,两个文件都不存在时生成自签名证书并保存
+func loadOrCreateCert(certFile, keyFile string) (tls.Certificate, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist) {
+		logrus.Warnf("证书 %s 和私钥 %s 不存在,生成自签名证书", certFile, keyFile)
+		if err := createSelfSignedCert(certFile, keyFile); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to create self-signed certificate: %v", err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// createSelfSignedCert 生成一个包含本机名、localhost 和回环地址的自签名证书
+func createSelfSignedCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	dnsNames := []string{"localhost"}
+	if hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+	now := time.Now()
+	// 普通的服务器证书而不是 CA,客户端信任它时不会同时信任用这个私钥签发的其他证书
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "http_proxy"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// handleTLSConn 返回 TLS 入站的连接处理函数
+// 完成 TLS 握手后和普通端口一样处理 HTTP 和 SOCKS 代理协议,
+// 客户端提供了证书时把证书的 CN 放进 context,之后每个请求的日志都会带上
+func handleTLSConn(tlsConfig *tls.Config) func(ctx context.Context, conn net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		log := requestLogger(ctx)
+		tlsConn := tls.Server(conn, tlsConfig)
+		handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			log.Errorf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			ctx = context.WithValue(ctx, clientCNKey, certs[0].Subject.CommonName)
+		}
+		handleMixedConn(ctx, tlsConn)
+	}
+}
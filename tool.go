@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/url"
 	"strings"
 )
@@ -18,3 +19,8 @@ func isHTTPS(reqLine string) bool {
 	// 判断是否是 https 协议
 	return parsedURL.Scheme == "https"
 }
+
+// joinHostPort 拼接 host:port,host 可以是带方括号或不带方括号的 IPv6 地址
+func joinHostPort(host, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// 嗅探时最多等待客户端发送数据的时间,超时后按原始目标 IP 路由
+	sniffTimeout = 2 * time.Second
+	// 等待客户端发送第一个字节的时间,超时说明是服务器先发送数据的协议(SSH、SMTP 等),不再嗅探
+	sniffFirstDataTimeout = 300 * time.Millisecond
+	// 嗅探使用的读缓冲,需要能放下完整的 ClientHello
+	sniffBufferSize = 16 * 1024
+)
+
+// handleTransparentConn 处理被 iptables 重定向过来的连接
+// 通过 SO_ORIGINAL_DST 取出原始目标,再从 TLS ClientHello 的 SNI 或者 HTTP 的 Host 中嗅探域名,
+// 有域名时按域名路由,否则按原始目标 IP 路由
+func handleTransparentConn(ctx context.Context, conn net.Conn) {
+	log := requestLogger(ctx)
+	// 透明代理没有可以回复错误的协议,超过连接限制时直接关闭
+	if limitRejection(ctx) != "" {
+		conn.Close()
+		return
+	}
+	dst, err := originalDst(conn)
+	if err != nil {
+		log.Errorf("获取原始目标地址失败: %v", err)
+		conn.Close()
+		return
+	}
+	// 没有经过重定向直接连到监听端口,转发给自己会形成循环
+	if local := conn.LocalAddr().(*net.TCPAddr); dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		log.Errorf("原始目标 %s 就是透明代理自身,拒绝连接", dst)
+		conn.Close()
+		return
+	}
+
+	bc := newBufferedConnSize(conn, sniffBufferSize)
+	host := sniffHost(bc, sniffTLSServerName, sniffHTTPHost)
+	if host == "" {
+		host = dst.IP.String()
+	}
+	port := strconv.Itoa(dst.Port)
+	log.Debugf("透明代理 client: %s original dst: %s host: %s", conn.RemoteAddr(), dst, host)
+
+	proxy_upstream := upstreams.pick()
+	upstream, ForwardMethod := getForwardMethodForHost(ctx, proxy_upstream, host, port, "transparent")
+	if ForwardMethod == "block" {
+		conn.Close()
+		return
+	}
+	// 直连时使用原始目标 IP,避免重新解析域名得到不同的地址
+	attempts := withDirectAddr(buildAttempts(ctx, upstream, ForwardMethod, host, port), dst.String())
+
+	target := joinHostPort(host, port)
+	reqLine := "CONNECT " + target + " HTTP/1.1\r\n" +
+		"Host: " + target + "\r\n" +
+		"\r\n"
+	targetConn, attempt, upstream_resp, err := dialTunnel(log, attempts, reqLine)
+	if err != nil {
+		log.Errorln("Error connecting to target:", err)
+		conn.Close()
+		return
+	}
+	if attempt.method == "proxy" && upstreamStatusCode(upstream_resp) != 200 {
+		log.Errorf("上游代理拒绝了 CONNECT %s: %q", target, upstream_resp)
+		targetConn.Close()
+		conn.Close()
+		return
+	}
+
+	// 开始转发数据
+	forward_io_copy(ctx, bc, targetConn, attempt)
+}
+
+// withDirectAddr 把 attempts 中直连的目标替换为 addr
+// 按嗅探到的域名路由时,直连仍然使用客户端原本要访问的地址
+func withDirectAddr(attempts []upstreamAttempt, addr string) []upstreamAttempt {
+	for i := range attempts {
+		if attempts[i].method == "direct" {
+			attempts[i].addr = addr
+		}
+	}
+	return attempts
+}
+
+// sniffHost 等待客户端发送数据并依次尝试 sniffers,返回嗅探到的域名
+// 客户端在 sniffFirstDataTimeout 内没有发送数据时立即返回,数据不属于任何协议、
+// 超时或者超过读缓冲时返回空字符串,已经读取的数据都保留在 bc 中
+func sniffHost(bc *bufferedConn, sniffers ...func(b []byte) (string, error)) string {
+	defer bc.SetReadDeadline(time.Time{})
+	bc.SetReadDeadline(time.Now().Add(sniffFirstDataTimeout))
+	if _, err := bc.Peek(1); err != nil {
+		return ""
+	}
+	bc.SetReadDeadline(time.Now().Add(sniffTimeout))
+
+	n := 1
+	for {
+		// Peek 出错时返回已经缓存的数据,仍然尝试嗅探一次
+		_, peekErr := bc.Peek(n)
+		// 一次读取可能得到比 n 更多的数据,嗅探所有已经缓存的数据
+		b, _ := bc.Peek(bc.br.Buffered())
+		incomplete := false
+		for _, sniff := range sniffers {
+			host, err := sniff(b)
+			if err == nil {
+				return host
+			}
+			incomplete = incomplete || errors.Is(err, errSniffIncomplete)
+		}
+		if !incomplete || peekErr != nil {
+			return ""
+		}
+		// 至少再读取一个字节
+		n = bc.br.Buffered() + 1
+	}
+}
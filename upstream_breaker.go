@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"    // 正常放行
+	breakerOpen     = "open"      // 熔断,流量切到其它上游
+	breakerHalfOpen = "half-open" // 冷却结束,放行一个探测请求
+)
+
+var breakerStateValue = map[string]float64{
+	breakerClosed:   0,
+	breakerOpen:     1,
+	breakerHalfOpen: 2,
+}
+
+// setBreakerState 切换熔断器状态,调用方需持有 u.mu
+func (u *upstreamHealth) setBreakerState(state string) {
+	if u.breaker == state {
+		return
+	}
+	logrus.Warnf("上游 %s 熔断器状态 %s -> %s", u.addr, u.breaker, state)
+	u.breaker = state
+	u.breakerSince = time.Now()
+	upstreamBreakerState.WithLabelValues(u.addr).Set(breakerStateValue[state])
+	upstreamBreakerTransitions.WithLabelValues(u.addr, state).Inc()
+}
+
+// state 返回熔断器对下一个请求的状态,不改变熔断器
+// closed 放行; half-open 可以发送一个探测请求(冷却结束的 open 也是); open 不放行(包括探测请求还没有结果的 half-open)
+func (u *upstreamHealth) state() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stateLocked(time.Now())
+}
+
+func (u *upstreamHealth) stateLocked(now time.Time) string {
+	switch u.breaker {
+	case breakerOpen:
+		if now.Sub(u.breakerSince) < u.cb.Cooldown {
+			return breakerOpen
+		}
+		return breakerHalfOpen
+	case breakerHalfOpen:
+		// 探测请求迟迟没有结果时再放行一个
+		if u.probing && now.Sub(u.probeSince) < u.cb.Cooldown {
+			return breakerOpen
+		}
+		return breakerHalfOpen
+	}
+	return breakerClosed
+}
+
+// acquire 在真正连接上游之前调用,熔断器不放行时返回 false
+// 冷却结束后转为 half-open 并占用唯一的探测名额,直到 reportResult 记录了探测结果
+func (u *upstreamHealth) acquire() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	switch u.stateLocked(now) {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		u.setBreakerState(breakerHalfOpen)
+		u.probing, u.probeSince = true, now
+	}
+	return true
+}
+
+// release 归还探测名额而不记录结果,下一个请求可以重新探测
+func (u *upstreamHealth) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probing = false
+}
+
+// reportResult 记录一次真实请求的结果
+func (u *upstreamHealth) reportResult(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probing = false
+	if err == nil {
+		u.passiveFailures = 0
+		u.setBreakerState(breakerClosed)
+		return
+	}
+
+	upstreamPassiveFailures.WithLabelValues(u.addr).Inc()
+	u.passiveFailures++
+	switch u.breaker {
+	case breakerHalfOpen:
+		// 探测请求失败,重新熔断
+		u.setBreakerState(breakerOpen)
+	case breakerClosed:
+		if u.passiveFailures >= u.cb.Failures {
+			u.setBreakerState(breakerOpen)
+		}
+	}
+}
+
+// usable 上游健康检查正常且熔断器放行,用于选择上游,不占用探测名额
+func (u *upstreamHealth) usable() bool {
+	return u.isHealthy() && u.state() != breakerOpen
+}
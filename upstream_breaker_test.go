@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withUpstreams 用 cfg 和 addrs 替换全局的 upstreams 和 domainForwardMap,测试结束时恢复
+func withUpstreams(t *testing.T, cfg Config, addrs ...string) *upstreamManager {
+	t.Helper()
+	oldUpstreams, oldConfig := upstreams, domainForwardMap
+	t.Cleanup(func() { upstreams, domainForwardMap = oldUpstreams, oldConfig })
+	m, err := newUpstreamManager(&cfg, addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.stop)
+	upstreams, domainForwardMap = m, cfg
+	return m
+}
+
+func newTestBreaker(failures int, cooldown time.Duration) *upstreamHealth {
+	return newUpstreamHealth("breaker.test:8080", nil, HealthCheck{}, CircuitBreaker{Failures: failures, Cooldown: cooldown})
+}
+
+func TestBreakerOpensAfterFailures(t *testing.T) {
+	u := newTestBreaker(2, time.Hour)
+	u.reportResult(errors.New("fail"))
+	if got := u.state(); got != breakerClosed {
+		t.Fatalf("after 1 failure state = %s, want closed", got)
+	}
+	u.reportResult(errors.New("fail"))
+	if got := u.state(); got != breakerOpen {
+		t.Fatalf("after 2 failures state = %s, want open", got)
+	}
+	if u.acquire() {
+		t.Fatal("acquire succeeded while open")
+	}
+	if u.usable() {
+		t.Fatal("usable while open")
+	}
+}
+
+// 选择上游(state/usable)不能占用 half-open 的探测名额
+func TestBreakerStateHasNoSideEffects(t *testing.T) {
+	u := newTestBreaker(1, 20*time.Millisecond)
+	u.reportResult(errors.New("fail"))
+	time.Sleep(30 * time.Millisecond)
+
+	for range 10 {
+		if !u.usable() || u.state() != breakerHalfOpen {
+			t.Fatalf("state = %s, want half-open after cooldown", u.state())
+		}
+	}
+	if u.breaker != breakerOpen {
+		t.Fatalf("state() changed breaker to %s", u.breaker)
+	}
+
+	if !u.acquire() {
+		t.Fatal("first acquire after cooldown refused")
+	}
+	if u.acquire() {
+		t.Fatal("second acquire allowed while the probe is in flight")
+	}
+	if u.usable() {
+		t.Fatal("usable while the probe is in flight")
+	}
+
+	// 探测成功后关闭熔断器
+	u.reportResult(nil)
+	if got := u.state(); got != breakerClosed || !u.acquire() {
+		t.Fatalf("after successful probe state = %s, want closed", got)
+	}
+}
+
+func TestBreakerProbeFailureReopens(t *testing.T) {
+	u := newTestBreaker(1, 20*time.Millisecond)
+	u.reportResult(errors.New("fail"))
+	time.Sleep(30 * time.Millisecond)
+	if !u.acquire() {
+		t.Fatal("acquire after cooldown refused")
+	}
+	u.reportResult(errors.New("probe failed"))
+	if got := u.state(); got != breakerOpen {
+		t.Fatalf("after failed probe state = %s, want open", got)
+	}
+}
+
+// 探测请求一直没有结果时,冷却时间之后再放行一个
+func TestBreakerStaleProbe(t *testing.T) {
+	u := newTestBreaker(1, 20*time.Millisecond)
+	u.reportResult(errors.New("fail"))
+	time.Sleep(30 * time.Millisecond)
+	if !u.acquire() {
+		t.Fatal("acquire after cooldown refused")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !u.acquire() {
+		t.Fatal("acquire refused after the probe went stale")
+	}
+}
+
+// 上游对 CONNECT 回复非 2xx 时计为失败,响应仍然交给调用方转发
+func TestDialTunnelCountsNon2xxAsFailure(t *testing.T) {
+	proxy := startTCPStub(t, stubConnectProxy("407 Proxy Authentication Required"))
+	m := withUpstreams(t, Config{CircuitBreaker: CircuitBreaker{Failures: 2, Cooldown: time.Hour}}, proxy)
+
+	log := discardLog()
+	attempts := []upstreamAttempt{{method: "proxy", addr: proxy}}
+	reqLine := "CONNECT example.test:443 HTTP/1.1\r\nHost: example.test:443\r\n\r\n"
+	for i := range 2 {
+		conn, _, resp, err := dialTunnel(log, attempts, reqLine)
+		if err != nil {
+			t.Fatalf("dialTunnel #%d: %v", i, err)
+		}
+		conn.Close()
+		if upstreamStatusCode(resp) != 407 {
+			t.Fatalf("response = %q, want 407", resp)
+		}
+	}
+	if got := m.byAddr[proxy].state(); got != breakerOpen {
+		t.Fatalf("state after two 407 = %s, want open", got)
+	}
+	if _, _, _, err := dialTunnel(log, attempts, reqLine); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("dialTunnel while open: err = %v, want errBreakerOpen", err)
+	}
+}
+
+// sendPlainRequest 通过代理发送一个普通 HTTP 请求,返回状态码,代理没有回复时返回 0
+func sendPlainRequest(t *testing.T, proxy, rawURL string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Close = true
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// 通过 proxy 上游的普通 HTTP 请求按请求的结果报告一次,连接成功本身不算成功
+func TestPlainHTTPReportsOncePerRequest(t *testing.T) {
+	// 接受请求后不回复直接关闭
+	proxy := startTCPStub(t, func(conn net.Conn) {
+		http.ReadRequest(bufio.NewReader(conn))
+	})
+	m := withUpstreams(t, Config{CircuitBreaker: CircuitBreaker{Failures: 2, Cooldown: time.Hour}}, proxy)
+	addr := startTestProxy(t)
+
+	for range 2 {
+		sendPlainRequest(t, addr, "http://origin.test/")
+	}
+	u := m.byAddr[proxy]
+	if got := u.state(); got != breakerOpen {
+		t.Fatalf("state after two failed requests = %s, want open (failures = %d)", got, u.passiveFailures)
+	}
+
+	// half-open 的探测请求失败时重新熔断,连接成功不能提前关闭熔断器
+	u.mu.Lock()
+	u.breakerSince = time.Now().Add(-2 * time.Hour)
+	u.mu.Unlock()
+	sendPlainRequest(t, addr, "http://origin.test/")
+	u.mu.Lock()
+	breaker := u.breaker
+	u.mu.Unlock()
+	if breaker != breakerOpen {
+		t.Fatalf("state after failed probe request = %s, want open", breaker)
+	}
+}
+
+// 熔断后不再复用连接池中到这个上游的连接
+func TestPooledConnRespectsBreaker(t *testing.T) {
+	var requests atomic.Int32
+	proxy := startTCPStub(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := http.ReadRequest(br); err != nil {
+				return
+			}
+			requests.Add(1)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}
+	})
+	m := withUpstreams(t, Config{CircuitBreaker: CircuitBreaker{Failures: 1, Cooldown: time.Hour}}, proxy)
+	addr := startTestProxy(t)
+
+	if status := sendPlainRequest(t, addr, "http://origin.test/a"); status != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", status)
+	}
+	c := httpConnPool.get(poolKey(upstreamAttempt{method: "proxy", addr: proxy}))
+	if c == nil {
+		t.Fatal("upstream connection was not pooled")
+	}
+	httpConnPool.put(c)
+	m.byAddr[proxy].reportResult(errors.New("fail"))
+
+	if status := sendPlainRequest(t, addr, "http://origin.test/b"); status == http.StatusOK {
+		t.Fatal("request through an open breaker succeeded")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("upstream received %d requests, want 1", n)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamManager 管理所有 proxy 上游,可以被多个 goroutine 并发使用
+// members 按优先级排列,members[0] 是首选的主上游。
+// 每次选择上游时都按优先级取第一个可用的,因此主上游恢复后流量会自动切回,
+// 不会像以前交换 proxyAddr/proxyAddrbak 那样停留在最后一个可用的上游上。
+type upstreamManager struct {
+	// members 创建后不再修改,读取不需要加锁
+	members []*upstreamHealth
+	byAddr  map[string]*upstreamHealth
+
+	mu     sync.Mutex
+	active string // 上一次选中的上游,只用于记录切换日志
+
+	done     chan struct{} // 关闭时停止健康检查
+	stopOnce sync.Once
+	checks   sync.WaitGroup
+}
+
+// newUpstreamManager 按优先级创建上游管理器,空地址会被忽略
+// 上游是域名时先同步解析一次,之后在后台按配置重新解析
+func newUpstreamManager(cfg *Config, addrs ...string) (*upstreamManager, error) {
+	m := &upstreamManager{byAddr: map[string]*upstreamHealth{}, done: make(chan struct{})}
+	for _, addr := range addrs {
+		if addr == "" || m.byAddr[addr] != nil {
+			continue
+		}
+		ua, err := newUpstreamAddrs(addr, cfg.upstreamResolve())
+		if err != nil {
+			return nil, err
+		}
+		if ua.isHostname() {
+			// 先同步解析一次,保证启动后的第一个请求就有可用的地址
+			time.AfterFunc(ua.refresh(), ua.run)
+		}
+		u := newUpstreamHealth(addr, ua, cfg.healthCheckFor(addr), cfg.circuitBreaker())
+		m.members = append(m.members, u)
+		m.byAddr[addr] = u
+	}
+	if len(m.members) > 0 {
+		m.active = m.members[0].addr
+	}
+	return m, nil
+}
+
+// startHealthChecks 为每个上游启动主动健康检查
+// 只有一个上游时也检查,健康状态和指标反映上游的真实情况
+func (m *upstreamManager) startHealthChecks() {
+	for _, u := range m.members {
+		logrus.Infof("上游 %s 健康检查: kind=%s url=%s interval=%s timeout=%s rise=%d fall=%d",
+			u.addr, u.hc.Kind, u.hc.URL, u.hc.Interval, u.hc.Timeout, u.hc.Rise, u.hc.Fall)
+		m.checks.Add(1)
+		go func() {
+			defer m.checks.Done()
+			u.run(m.done, func(*upstreamHealth) { m.pick() })
+		}()
+	}
+}
+
+// stop 停止健康检查,等待正在进行的检查结束
+func (m *upstreamManager) stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+	m.checks.Wait()
+}
+
+// primary 返回首选的主上游,没有配置上游时返回空字符串
+func (m *upstreamManager) primary() string {
+	if len(m.members) == 0 {
+		return ""
+	}
+	return m.members[0].addr
+}
+
+// pick 返回当前应该使用的上游: 按优先级第一个健康且熔断器放行的上游
+// 全部不可用时返回主上游
+func (m *upstreamManager) pick() string {
+	addr, found := m.primary(), false
+	for _, u := range m.members {
+		if u.usable() {
+			addr, found = u.addr, true
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if addr != m.active {
+		if !found {
+			logrus.Error("所有上游都不可用，使用主上游 ", addr)
+		} else if addr == m.primary() {
+			logrus.Info("主上游 ", addr, " 已恢复，切回主上游")
+		} else {
+			logrus.Warn("上游 ", m.active, " 不可用，切换到上游 ", addr)
+		}
+		m.active = addr
+	}
+	return addr
+}
+
+// others 按优先级返回除 exclude 之外当前可用的上游,用于失败重试
+func (m *upstreamManager) others(exclude string) []string {
+	var addrs []string
+	for _, u := range m.members {
+		if u.addr != exclude && u.usable() {
+			addrs = append(addrs, u.addr)
+		}
+	}
+	return addrs
+}
+
+// acquire 在连接上游之前检查熔断器,addr 不是受管理的上游时总是放行
+func (m *upstreamManager) acquire(addr string) bool {
+	u := m.byAddr[addr]
+	return u == nil || u.acquire()
+}
+
+// release 归还 acquire 占用的探测名额,没有得到请求结果时调用,addr 不是受管理的上游时忽略
+func (m *upstreamManager) release(addr string) {
+	if u := m.byAddr[addr]; u != nil {
+		u.release()
+	}
+}
+
+// report 把与上游交互的结果计入上游的健康状态,addr 不是受管理的上游时忽略
+func (m *upstreamManager) report(log *logrus.Entry, addr string, err error) {
+	u := m.byAddr[addr]
+	if u == nil {
+		return
+	}
+	if err != nil {
+		log.Warnf("上游 %s 请求失败: %v", addr, err)
+	}
+	u.reportResult(err)
+}
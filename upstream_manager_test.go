@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamManagerFailBack(t *testing.T) {
+	m := withUpstreams(t, Config{HealthCheck: HealthCheck{Rise: 1, Fall: 1}}, "primary.test:1", "backup.test:1")
+	primary, backup := m.byAddr["primary.test:1"], m.byAddr["backup.test:1"]
+
+	if got := m.pick(); got != "primary.test:1" {
+		t.Fatalf("pick = %s, want primary", got)
+	}
+	primary.record(false)
+	if got := m.pick(); got != "backup.test:1" {
+		t.Fatalf("pick with primary down = %s, want backup", got)
+	}
+	if got := m.others("backup.test:1"); len(got) != 0 {
+		t.Fatalf("others = %v, want none", got)
+	}
+	// 主上游恢复后自动切回
+	primary.record(true)
+	if got := m.pick(); got != "primary.test:1" {
+		t.Fatalf("pick after primary recovered = %s, want primary", got)
+	}
+	// 全部不可用时返回主上游
+	primary.record(false)
+	backup.record(false)
+	if got := m.pick(); got != "primary.test:1" {
+		t.Fatalf("pick with all down = %s, want primary", got)
+	}
+}
+
+func TestUpstreamManagerBreakerFailover(t *testing.T) {
+	m := withUpstreams(t, Config{CircuitBreaker: CircuitBreaker{Failures: 1, Cooldown: time.Hour}}, "primary.test:1", "backup.test:1")
+	m.report(discardLog(), "primary.test:1", errors.New("fail"))
+	if got := m.pick(); got != "backup.test:1" {
+		t.Fatalf("pick with primary breaker open = %s, want backup", got)
+	}
+	if got := m.others(""); !slices.Equal(got, []string{"backup.test:1"}) {
+		t.Fatalf("others = %v, want [backup.test:1]", got)
+	}
+	if m.acquire("primary.test:1") {
+		t.Fatal("acquire allowed the open primary")
+	}
+	if !m.acquire("unmanaged.test:1") {
+		t.Fatal("acquire refused an unmanaged upstream")
+	}
+	m.report(discardLog(), "primary.test:1", nil)
+	if got := m.pick(); got != "primary.test:1" {
+		t.Fatalf("pick after success = %s, want primary", got)
+	}
+}
+
+// 用 -race 运行: 选择上游、报告结果、熔断器和健康检查结果并发进行
+func TestUpstreamManagerConcurrent(t *testing.T) {
+	addrs := []string{"a.test:1", "b.test:1", "c.test:1"}
+	m := withUpstreams(t, Config{CircuitBreaker: CircuitBreaker{Failures: 2, Cooldown: time.Millisecond}}, addrs...)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				addr := addrs[(g+i)%len(addrs)]
+				switch i % 5 {
+				case 0:
+					if got := m.pick(); !slices.Contains(addrs, got) {
+						t.Errorf("pick = %q, not a member", got)
+						return
+					}
+				case 1:
+					m.others(addr)
+				case 2:
+					var err error
+					if i%3 == 0 {
+						err = errors.New("fail")
+					}
+					m.report(discardLog(), addr, err)
+				case 3:
+					if m.acquire(addr) {
+						m.report(discardLog(), addr, nil)
+					}
+				case 4:
+					m.byAddr[addr].record(i%2 == 0)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 只有一个上游时也做主动健康检查
+func TestHealthChecksSingleUpstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	m := withUpstreams(t, Config{HealthCheck: HealthCheck{Kind: "tcp", Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond, Rise: 1, Fall: 1}}, addr)
+	m.startHealthChecks()
+	u := m.byAddr[addr]
+	deadline := time.Now().Add(2 * time.Second)
+	for u.isHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("unreachable single upstream still healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pooledConn 普通 HTTP 转发使用的上游连接
+// 连接会带着自己的 bufio.Reader 在多个请求之间复用
+type pooledConn struct {
+	*bufferedConn
+	key    string
+	reused bool // 是否是从连接池中取出的连接
+
+	// 以下字段只在连接空闲时使用
+	timer    *time.Timer
+	peekDone chan error
+}
+
+func newPooledConn(conn net.Conn, key string) *pooledConn {
+	return &pooledConn{bufferedConn: newBufferedConn(conn), key: key}
+}
+
+// poolKey 连接池的键,直连时是目标 host:port,通过 proxy 时是上游地址
+func poolKey(a upstreamAttempt) string {
+	return a.method + "|" + a.addr
+}
+
+// connPool 按目标保存空闲的上游连接
+type connPool struct {
+	cfg UpstreamPool
+
+	mu    sync.Mutex
+	idle  map[string][]*pooledConn
+	total int
+}
+
+var httpConnPool *connPool
+
+func newConnPool(cfg UpstreamPool) *connPool {
+	return &connPool{cfg: cfg, idle: map[string][]*pooledConn{}}
+}
+
+// get 取出一个可用的空闲连接,没有时返回 nil
+func (p *connPool) get(key string) *pooledConn {
+	if p.cfg.Disable {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			upstreamPoolRequests.WithLabelValues("miss").Inc()
+			return nil
+		}
+		// 优先使用最近放回的连接
+		c := conns[len(conns)-1]
+		p.removeLocked(c)
+		p.mu.Unlock()
+
+		c.timer.Stop()
+		if c.wake() {
+			c.reused = true
+			upstreamPoolRequests.WithLabelValues("hit").Inc()
+			return c
+		}
+		c.Close()
+	}
+}
+
+// put 把完成请求的连接放回连接池,超过上限时直接关闭
+func (p *connPool) put(c *pooledConn) {
+	if p.cfg.Disable {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	if p.total >= p.cfg.MaxIdle || len(p.idle[c.key]) >= p.cfg.MaxIdlePerHost {
+		p.mu.Unlock()
+		c.Close()
+		return
+	}
+	// 空闲超时后关闭
+	c.timer = time.AfterFunc(p.cfg.IdleTimeout, func() { p.discard(c) })
+	// 空闲时在后台读取,对端关闭连接时及时从连接池中移除
+	c.peekDone = make(chan error, 1)
+	go func() {
+		_, err := c.br.Peek(1)
+		c.peekDone <- err
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			p.discard(c)
+		}
+	}()
+	p.idle[c.key] = append(p.idle[c.key], c)
+	p.total++
+	upstreamPoolIdle.Set(float64(p.total))
+	p.mu.Unlock()
+}
+
+// wake 停止后台读取,返回连接是否还能使用
+func (c *pooledConn) wake() bool {
+	c.SetReadDeadline(time.Now())
+	err := <-c.peekDone
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		// 对端已经关闭连接,或者在没有请求的时候发来了数据
+		logrus.Debugf("连接池中的连接 %s 已失效: %v", c.key, err)
+		return false
+	}
+	return c.SetReadDeadline(time.Time{}) == nil
+}
+
+// discard 把空闲连接从连接池中移除并关闭,连接已经被取走时什么都不做
+func (p *connPool) discard(c *pooledConn) {
+	p.mu.Lock()
+	removed := p.removeLocked(c)
+	p.mu.Unlock()
+	if removed {
+		c.Close()
+	}
+}
+
+func (p *connPool) removeLocked(c *pooledConn) bool {
+	conns := p.idle[c.key]
+	for i, ic := range conns {
+		if ic == c {
+			p.idle[c.key] = append(conns[:i], conns[i+1:]...)
+			if len(p.idle[c.key]) == 0 {
+				delete(p.idle, c.key)
+			}
+			p.total--
+			upstreamPoolIdle.Set(float64(p.total))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lookupUpstreamIP 使用名为 resolver 的解析器解析上游域名,返回的 ttl 为 0 表示解析器没有提供 TTL
+// 系统解析器不提供 TTL;测试时可以替换为桩实现
+var lookupUpstreamIP = func(ctx context.Context, resolver, host string) ([]net.IP, time.Duration, error) {
+	if r, ok := directResolvers[resolver].(*dnsResolver); ok {
+		return r.lookupIPTTL(ctx, host)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	return ips, 0, err
+}
+
+// TTL 很短时也至少间隔这么久再重新解析
+const minUpstreamResolveInterval = time.Second
+
+// upstreamAddrs 保存上游域名的解析结果并定期刷新
+// 上游地址始终以 host:port 的形式保存,只在建立连接时使用解析出的 IP
+type upstreamAddrs struct {
+	host string
+	port string
+	cfg  UpstreamResolve
+
+	mu  sync.RWMutex
+	ips []net.IP
+}
+
+func newUpstreamAddrs(addr string, cfg UpstreamResolve) (*upstreamAddrs, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split host and port from proxy address: %v", err)
+	}
+	r := &upstreamAddrs{host: host, port: port, cfg: cfg}
+	if ip := net.ParseIP(host); ip != nil {
+		r.ips = []net.IP{ip}
+	}
+	return r, nil
+}
+
+// isHostname 上游是否是域名,IP 地址不需要解析
+func (r *upstreamAddrs) isHostname() bool {
+	return net.ParseIP(r.host) == nil
+}
+
+// refresh 重新解析一次,返回下一次解析前应等待的时间
+func (r *upstreamAddrs) refresh() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, ttl, err := lookupUpstreamIP(ctx, r.cfg.Resolver, r.host)
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no addresses found")
+	}
+	if err != nil {
+		// 解析失败时保留上一次的结果
+		logrus.Errorf("解析上游 %s 失败: %v", r.host, err)
+		return r.cfg.Interval
+	}
+
+	ips = sortIPsByPreference(ips, r.cfg.Prefer)
+	r.mu.Lock()
+	changed := fmt.Sprint(r.ips) != fmt.Sprint(ips)
+	r.ips = ips
+	r.mu.Unlock()
+	if changed {
+		logrus.Infof("上游 %s 解析结果: %v", r.host, ips)
+	}
+
+	if ttl > 0 && ttl < r.cfg.Interval {
+		return max(ttl, minUpstreamResolveInterval)
+	}
+	return r.cfg.Interval
+}
+
+// run 按 TTL 或配置的间隔持续重新解析
+func (r *upstreamAddrs) run() {
+	if !r.isHostname() {
+		return
+	}
+	for {
+		time.Sleep(r.refresh())
+	}
+}
+
+// dial 使用 happy eyeballs 连接解析出的地址
+// 还没有解析结果时交给系统解析器
+func (r *upstreamAddrs) dial(timeout time.Duration) (net.Conn, error) {
+	r.mu.RLock()
+	ips := r.ips
+	r.mu.RUnlock()
+	if len(ips) == 0 {
+		return net.DialTimeout("tcp", net.JoinHostPort(r.host, r.port), timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return dialHappyEyeballs(ctx, ips, r.port, r.cfg.FallbackDelay)
+}
+
+// sortIPsByPreference 按偏好的地址族排序,两个地址族交替排列 (RFC 8305)
+// prefer 为空时按第一个地址的地址族开始交替
+func sortIPsByPreference(ips []net.IP, prefer string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v4, v6
+	switch prefer {
+	case "ipv6":
+		first, second = v6, v4
+	case "ipv4":
+	default:
+		if len(ips) > 0 && ips[0].To4() == nil {
+			first, second = v6, v4
+		}
+	}
+
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// dialHappyEyeballs 依次向 ips 发起连接,每隔 delay 或上一个连接失败时启动下一个,
+// 返回最先建立成功的连接,其余连接会被关闭
+func dialHappyEyeballs(ctx context.Context, ips []net.IP, port string, delay time.Duration) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	var d net.Dialer
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{c, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭其余还在进行中的连接
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if other := <-results; other.conn != nil {
+							other.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(ips) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialUpstream 连接 proxy 上游,受管理的上游使用缓存的解析结果
+func dialUpstream(addr string, timeout time.Duration) (net.Conn, error) {
+	if upstreams != nil {
+		if u := upstreams.byAddr[addr]; u != nil {
+			return u.addrs.dial(timeout)
+		}
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRefreshInterval(t *testing.T) {
+	old := lookupUpstreamIP
+	t.Cleanup(func() { lookupUpstreamIP = old })
+
+	cfg := UpstreamResolve{Interval: time.Minute, Prefer: "ipv6"}
+	r, err := newUpstreamAddrs("proxy.test:8080", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		err     error
+		want    time.Duration
+		wantIPs []string
+	}{
+		{"ttl shorter than interval", 5 * time.Second, nil, 5 * time.Second, []string{"2001:db8::1", "192.0.2.1"}},
+		{"no ttl", 0, nil, time.Minute, []string{"2001:db8::1", "192.0.2.1"}},
+		{"ttl longer than interval", time.Hour, nil, time.Minute, []string{"2001:db8::1", "192.0.2.1"}},
+		{"tiny ttl", 100 * time.Millisecond, nil, minUpstreamResolveInterval, []string{"2001:db8::1", "192.0.2.1"}},
+		// 解析失败时保留上一次的结果
+		{"lookup error", 5 * time.Second, errors.New("servfail"), time.Minute, []string{"2001:db8::1", "192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		lookupUpstreamIP = func(ctx context.Context, resolver, host string) ([]net.IP, time.Duration, error) {
+			if tt.err != nil {
+				return nil, 0, tt.err
+			}
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, tt.ttl, nil
+		}
+		if got := r.refresh(); got != tt.want {
+			t.Errorf("%s: refresh = %v, want %v", tt.name, got, tt.want)
+		}
+		var ips []string
+		for _, ip := range r.ips {
+			ips = append(ips, ip.String())
+		}
+		if !slices.Equal(ips, tt.wantIPs) {
+			t.Errorf("%s: ips = %v, want %v", tt.name, ips, tt.wantIPs)
+		}
+	}
+}
+
+// 配置的解析器返回记录的 TTL,缓存命中时返回剩余的 TTL
+func TestLookupUpstreamIPWithResolverTTL(t *testing.T) {
+	zone := stubZone{ttl: 30, addrs: map[string][]string{"proxy.test": {"192.0.2.1", "2001:db8::1"}}}
+	var queries atomic.Int32
+	r := newStubResolver("stub", exchangeFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		queries.Add(1)
+		return zone.answer(t, query), nil
+	}))
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+	withDirectResolvers(t, map[string]hostResolver{"stub": r})
+
+	ips, ttl, err := lookupUpstreamIP(context.Background(), "stub", "proxy.test")
+	if err != nil || len(ips) != 2 || ttl != 30*time.Second {
+		t.Fatalf("lookup = %v, %v, %v; want 2 addresses with ttl 30s", ips, ttl, err)
+	}
+	now = now.Add(10 * time.Second)
+	_, ttl, err = lookupUpstreamIP(context.Background(), "stub", "proxy.test")
+	if err != nil || ttl != 20*time.Second || queries.Load() != 2 {
+		t.Fatalf("cached lookup ttl = %v, err = %v, queries = %d; want 20s from cache", ttl, err, queries.Load())
+	}
+}
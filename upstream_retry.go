@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upstreamAttempt 一次连接尝试: 通过 proxy 上游,或者直连目标
+type upstreamAttempt struct {
+	method   string // proxy / direct
+	addr     string // proxy 上游地址或者直连目标的 host:port
+	resolver string // 直连时解析目标域名使用的解析器名字
+	rule     *Rule  // 路由匹配的规则,没有匹配时为 nil
+}
+
+// buildAttempts 根据路由结果生成依次尝试的列表
+// proxy 方式先尝试选中的上游,再尝试其它可用的上游(用户策略固定了上游时除外),规则允许时最后尝试直连
+func buildAttempts(ctx context.Context, upstreamHost, method, host, port string) []upstreamAttempt {
+	rule := matchRule(ctx, host)
+	resolver := directResolverName(rule)
+	attempts := []upstreamAttempt{{method: method, addr: upstreamHost, resolver: resolver, rule: rule}}
+	if method != "proxy" {
+		return attempts
+	}
+
+	// 用户策略固定了上游时不换到其它上游
+	if policy := matchUserPolicy(ctx); policy == nil || policy.Upstream == "" {
+		for _, addr := range upstreams.others(upstreamHost) {
+			attempts = append(attempts, upstreamAttempt{method: "proxy", addr: addr, rule: rule})
+		}
+	}
+
+	if rule != nil && rule.FallbackDirect {
+		attempts = append(attempts, upstreamAttempt{method: "direct", addr: joinHostPort(host, port), resolver: resolver, rule: rule})
+	}
+
+	if max := domainForwardMap.retry().Attempts; len(attempts) > max {
+		attempts = attempts[:max]
+	}
+	return attempts
+}
+
+// errBreakerOpen 上游的熔断器没有放行
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// upstreamStatusError 上游代理对 CONNECT 回复了非 2xx 的状态
+// 计为上游的一次失败,但连接仍然返回给调用方,由调用方把上游的响应转发给客户端
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream CONNECT returned status %d", e.status)
+}
+
+// dialAttempts 依次尝试 attempts 直到成功,返回建立好的连接和成功的那次尝试
+// handshake 不为空时在连接建立后执行(例如发送 CONNECT),失败同样会换下一个尝试
+// 每次尝试(连接和握手)都受 retry.timeout 限制
+func dialAttempts(log *logrus.Entry, attempts []upstreamAttempt, handshake func(c *bufferedConn, a upstreamAttempt) error) (net.Conn, upstreamAttempt, error) {
+	timeout := domainForwardMap.retry().Timeout
+	var errs []error
+	for i, a := range attempts {
+		if a.method == "proxy" && !upstreams.acquire(a.addr) {
+			log.Warnf("第 %d/%d 次尝试跳过: 上游 %s 已熔断", i+1, len(attempts), a.addr)
+			errs = append(errs, fmt.Errorf("%s %s: %w", a.method, a.addr, errBreakerOpen))
+			continue
+		}
+		log.Infof("第 %d/%d 次尝试: method: %s upstream: %s", i+1, len(attempts), a.method, a.addr)
+		conn, err := dialAttempt(a, timeout, handshake)
+		// 没有握手时(普通 HTTP 请求)连接成功还不代表请求成功,由调用方在请求结束后报告
+		if a.method == "proxy" && (err != nil || handshake != nil) {
+			upstreams.report(log, a.addr, err)
+		}
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			// 上游的错误响应由调用方转发给客户端,不再重试
+			log.Warnf("第 %d/%d 次尝试: 上游 %s 拒绝了请求: %v", i+1, len(attempts), a.addr, err)
+			return conn, a, nil
+		}
+		if err != nil {
+			log.Warnf("第 %d/%d 次尝试失败: method: %s upstream: %s error: %v", i+1, len(attempts), a.method, a.addr, err)
+			errs = append(errs, fmt.Errorf("%s %s: %w", a.method, a.addr, err))
+			continue
+		}
+		logConnectionType(log, a.addr, conn)
+		return conn, a, nil
+	}
+	return nil, upstreamAttempt{}, errors.Join(errs...)
+}
+
+func dialAttempt(a upstreamAttempt, timeout time.Duration, handshake func(c *bufferedConn, a upstreamAttempt) error) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if a.method == "proxy" {
+		conn, err = dialUpstream(a.addr, timeout)
+	} else {
+		conn, err = dialDirect(a, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if handshake == nil {
+		return conn, nil
+	}
+
+	// 握手时读取响应可能多读到后面的数据,之后通过 bufferedConn 读取
+	bc := newBufferedConn(conn)
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := handshake(bc, a); err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			return bc, err
+		}
+		conn.Close()
+		return nil, err
+	}
+	// 握手完成后清除超时,隧道的生命周期由客户端决定
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// dialDirect 直连目标,使用 attempt 选择的解析器解析域名后按 happy eyeballs 连接
+// 使用系统解析器时交给 net.Dial 处理
+func dialDirect(a upstreamAttempt, timeout time.Duration) (net.Conn, error) {
+	if _, ok := directResolvers[a.resolver]; !ok {
+		return net.DialTimeout("tcp", a.addr, timeout)
+	}
+	host, port, err := net.SplitHostPort(a.addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := lookupDirect(ctx, a.resolver, host)
+	if err != nil {
+		return nil, err
+	}
+	resolve := domainForwardMap.upstreamResolve()
+	return dialHappyEyeballs(ctx, sortIPsByPreference(ips, resolve.Prefer), port, resolve.FallbackDelay)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// requestUser 返回请求的身份: 通过代理认证的用户名,没有时使用 mTLS 客户端证书的 CN
+// 都没有时返回空字符串,按用户和用户组限定的规则和策略都不会匹配
+func requestUser(ctx context.Context) string {
+	if user, ok := ctx.Value(proxyUserKey).(string); ok && user != "" {
+		return user
+	}
+	cn, _ := ctx.Value(clientCNKey).(string)
+	return cn
+}
+
+// userMatches 判断 user 是否是 users 中的用户或者 groups 中某个组的成员
+func userMatches(user string, users, groups []string) bool {
+	if user == "" {
+		return false
+	}
+	if slices.Contains(users, user) {
+		return true
+	}
+	for _, g := range groups {
+		if slices.Contains(domainForwardMap.Groups[g], user) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchUserPolicy 返回请求身份适用的第一个策略,没有时返回 nil
+func matchUserPolicy(ctx context.Context) *UserPolicy {
+	user := requestUser(ctx)
+	if user == "" {
+		return nil
+	}
+	for i := range domainForwardMap.UserPolicies {
+		p := &domainForwardMap.UserPolicies[i]
+		if userMatches(user, p.Users, p.Groups) {
+			return p
+		}
+	}
+	return nil
+}
+
+// checkUserPolicies 检查规则和策略引用的用户组都存在,策略的 defaultMethod 有效
+func checkUserPolicies(cfg *Config) error {
+	checkGroups := func(groups []string) error {
+		for _, g := range groups {
+			if _, ok := cfg.Groups[g]; !ok {
+				return fmt.Errorf("unknown group %q", g)
+			}
+		}
+		return nil
+	}
+	for _, rule := range cfg.Rules {
+		if err := checkGroups(rule.Groups); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.DomainPattern, err)
+		}
+	}
+	for i, p := range cfg.UserPolicies {
+		if len(p.Users) == 0 && len(p.Groups) == 0 {
+			return fmt.Errorf("userPolicies[%d]: no users or groups", i)
+		}
+		if err := checkGroups(p.Groups); err != nil {
+			return fmt.Errorf("userPolicies[%d]: %v", i, err)
+		}
+		switch p.DefaultMethod {
+		case "", "direct", "proxy", "block":
+		default:
+			return fmt.Errorf("userPolicies[%d]: invalid defaultMethod %q", i, p.DefaultMethod)
+		}
+	}
+	return nil
+}
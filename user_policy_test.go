@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+const (
+	testGlobalUpstream = "global.test:8080"
+	testPinnedUpstream = "pinned.test:3128"
+)
+
+// userPolicyConfig 用户和用户组各有策略和规则的配置
+// carol 同时是 contractor 组的成员和单独策略的用户,按配置顺序先匹配组的策略
+func userPolicyConfig() Config {
+	return Config{
+		Groups: map[string][]string{
+			"contractor": {"bob", "carol"},
+			"ops":        {"dave"},
+		},
+		UserPolicies: []UserPolicy{
+			{Users: []string{"alice"}, Upstream: testPinnedUpstream},
+			{Groups: []string{"contractor"}, DefaultMethod: "block"},
+			{Groups: []string{"ops"}, DefaultMethod: "direct"},
+			{Users: []string{"carol"}, DefaultMethod: "proxy"},
+		},
+		Rules: []Rule{
+			{DomainPattern: "*.corp.test", ForwardMethod: "direct", Groups: []string{"contractor"}},
+			{DomainPattern: "news.test", ForwardMethod: "block", Users: []string{"dave"}},
+			{DomainPattern: "news.test", ForwardMethod: "proxy"},
+		},
+	}
+}
+
+func userContext(proxyUser, cn string) context.Context {
+	ctx := context.Background()
+	if proxyUser != "" {
+		ctx = context.WithValue(ctx, proxyUserKey, proxyUser)
+	}
+	if cn != "" {
+		ctx = context.WithValue(ctx, clientCNKey, cn)
+	}
+	return ctx
+}
+
+func TestGetForwardMethodForUser(t *testing.T) {
+	withUpstreams(t, userPolicyConfig(), testGlobalUpstream)
+	tests := []struct {
+		name         string
+		proxyUser    string
+		cn           string
+		host         string
+		wantMethod   string
+		wantUpstream string
+	}{
+		{"anonymous global rule", "", "", "news.test", "proxy", testGlobalUpstream},
+		{"anonymous domain default", "", "", "example.org", "proxy", testGlobalUpstream},
+		{"anonymous ip default", "", "", "192.0.2.1", "direct", "192.0.2.1:443"},
+		{"anonymous skips group rule", "", "", "wiki.corp.test", "proxy", testGlobalUpstream},
+		{"user rule before global rule", "dave", "", "news.test", "block", ""},
+		{"group rule", "bob", "", "wiki.corp.test", "direct", "wiki.corp.test:443"},
+		{"global rule before policy default", "bob", "", "news.test", "proxy", testGlobalUpstream},
+		{"group policy default", "bob", "", "example.org", "block", ""},
+		{"first matching policy wins", "carol", "", "example.org", "block", ""},
+		{"other group policy default", "dave", "", "example.org", "direct", "example.org:443"},
+		{"pinned upstream with global default", "alice", "", "example.org", "proxy", testPinnedUpstream},
+		{"pinned upstream with rule", "alice", "", "news.test", "proxy", testPinnedUpstream},
+		{"pinned upstream keeps ip default", "alice", "", "192.0.2.1", "direct", "192.0.2.1:443"},
+		{"unknown user falls back", "mallory", "", "example.org", "proxy", testGlobalUpstream},
+		{"unknown user skips group rule", "mallory", "", "wiki.corp.test", "proxy", testGlobalUpstream},
+		{"client cn identity", "", "dave", "example.org", "direct", "example.org:443"},
+		{"proxy user before client cn", "bob", "dave", "example.org", "block", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := userContext(tt.proxyUser, tt.cn)
+			upstream, method := getForwardMethodForHost(ctx, testGlobalUpstream, tt.host, "443", "https")
+			if method != tt.wantMethod || upstream != tt.wantUpstream {
+				t.Fatalf("getForwardMethodForHost(%s) = (%q, %q), want (%q, %q)",
+					tt.host, upstream, method, tt.wantUpstream, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestMatchRuleForUser(t *testing.T) {
+	withUpstreams(t, userPolicyConfig(), testGlobalUpstream)
+	cfg := &domainForwardMap
+	tests := []struct {
+		user string
+		host string
+		want *Rule
+	}{
+		{"", "wiki.corp.test", nil},
+		{"bob", "wiki.corp.test", &cfg.Rules[0]},
+		{"carol", "wiki.corp.test", &cfg.Rules[0]},
+		{"dave", "wiki.corp.test", nil},
+		{"dave", "news.test", &cfg.Rules[1]},
+		{"bob", "news.test", &cfg.Rules[2]},
+		{"mallory", "news.test", &cfg.Rules[2]},
+		{"mallory", "example.org", nil},
+	}
+	for _, tt := range tests {
+		if got := matchRule(userContext(tt.user, ""), tt.host); got != tt.want {
+			t.Errorf("matchRule(%q, %s) = %+v, want %+v", tt.user, tt.host, got, tt.want)
+		}
+	}
+}
+
+// 策略固定了上游时不换到其它上游,其它用户仍然可以换到其它上游
+func TestPinnedUpstreamAttempts(t *testing.T) {
+	withUpstreams(t, userPolicyConfig(), testGlobalUpstream, "backup.test:8080")
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{"alice", []string{testPinnedUpstream}},
+		{"bob", []string{testGlobalUpstream, "backup.test:8080"}},
+		{"mallory", []string{testGlobalUpstream, "backup.test:8080"}},
+	}
+	for _, tt := range tests {
+		ctx := userContext(tt.user, "")
+		upstream, method := getForwardMethodForHost(ctx, testGlobalUpstream, "news.test", "443", "https")
+		var got []string
+		for _, a := range buildAttempts(ctx, upstream, method, "news.test", "443") {
+			got = append(got, a.addr)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: attempts = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestCheckUserPolicies(t *testing.T) {
+	groups := map[string][]string{"ops": {"dave"}}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"valid", userPolicyConfig(), false},
+		{"rule with unknown group", Config{Groups: groups, Rules: []Rule{{DomainPattern: "a.test", ForwardMethod: "direct", Groups: []string{"dev"}}}}, true},
+		{"policy with unknown group", Config{Groups: groups, UserPolicies: []UserPolicy{{Groups: []string{"dev"}}}}, true},
+		{"policy without users", Config{UserPolicies: []UserPolicy{{DefaultMethod: "direct"}}}, true},
+		{"invalid default method", Config{UserPolicies: []UserPolicy{{Users: []string{"alice"}, DefaultMethod: "reject"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := checkUserPolicies(&tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkUserPolicies() err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}